@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// Captions telling family members something about each photo, rather
+// than just its filename: its own caption from its notes if it has
+// one, then when it was taken, where (from its GPS position and the
+// gazetteer) and with what camera. Any of them can be missing.
+
+type Caption struct {
+	Text   string `json:"text,omitempty"`
+	Date   string `json:"date,omitempty"` // e.g. "17 October 2019"
+	Place  string `json:"place,omitempty"`
+	Camera string `json:"camera,omitempty"`
+}
+
+const caption_date_layout = "2 January 2006"
+
+func caption_for(record PhotoRecord) *Caption {
+	// nil if there's nothing to say
+	caption := &Caption{Camera: record.Camera}
+	if !record.Taken.IsZero() {
+		caption.Date = record.Taken.Format(caption_date_layout)
+	}
+	if record.GPS != nil {
+		if place, found := gazetteer.nearest(*record.GPS, config.Captions.PlaceDistanceKm); found {
+			caption.Place = place.Name
+		}
+	}
+	caption.Text = record.Caption
+
+	if *caption == (Caption{}) {
+		return nil
+	}
+	return caption
+}
+
+func add_captions(snap_set *SnapshotSet) {
+	for _, snap := range snap_set.Snaps {
+		record, err := photo_index.lookup(snap.Location)
+		if err != nil {
+			log.Printf("No caption for %v: %v\n", snap.Location, err)
+			continue
+		}
+		snap.Caption = caption_for(record)
+	}
+}
+
+func (caption *Caption) lines() []string {
+	// As shown under a photo, the caption's own text on a line of its
+	// own then the rest, matching composite.html
+	lines := make([]string, 0, 2)
+	if caption.Text != "" {
+		lines = append(lines, caption.Text)
+	}
+	details := make([]string, 0, 3)
+	for _, detail := range []string{caption.Place, caption.Date, caption.Camera} {
+		if detail != "" {
+			details = append(details, detail)
+		}
+	}
+	if len(details) > 0 {
+		lines = append(lines, strings.Join(details, ", "))
+	}
+	return lines
+}
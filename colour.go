@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Colour theory on MyCol, for choosing a matt to go with the photos.
+// Hue and saturation are easiest to reason about in HSL, but lightness
+// is judged in CIELAB (D65 white) since HSL's lightness takes no account
+// of how much brighter yellow looks than blue.
+
+// How light the matt should look, as CIELAB L* (0 black, 100 white).
+// Dark enough that the photos stand out, light enough to see its colour
+const matt_lightness = 28.0
+
+func (col MyCol) ToHSL() (hue float64, saturation float64, lightness float64) {
+	// Hue in degrees 0-360, saturation and lightness 0-1
+	r, g, b := col.unit()
+	high := math.Max(r, math.Max(g, b))
+	low := math.Min(r, math.Min(g, b))
+	lightness = (high + low) / 2
+	if high == low {
+		return 0, 0, lightness
+	}
+	chroma := high - low
+	saturation = chroma / (1 - math.Abs(2*lightness-1))
+	switch high {
+	case r:
+		hue = math.Mod((g-b)/chroma+6, 6)
+	case g:
+		hue = (b-r)/chroma + 2
+	default:
+		hue = (r-g)/chroma + 4
+	}
+	return hue * 60, saturation, lightness
+}
+
+func FromHSL(hue float64, saturation float64, lightness float64) MyCol {
+	hue = math.Mod(math.Mod(hue, 360)+360, 360)
+	saturation = clamp_unit(saturation)
+	lightness = clamp_unit(lightness)
+	chroma := (1 - math.Abs(2*lightness-1)) * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	m := lightness - chroma/2
+	return from_unit(r+m, g+m, b+m)
+}
+
+func (col MyCol) ToLab() (l float64, a float64, b float64) {
+	red, green, blue := col.unit()
+	red, green, blue = srgb_to_linear(red), srgb_to_linear(green), srgb_to_linear(blue)
+	x := (0.4124564*red + 0.3575761*green + 0.1804375*blue) / 0.95047
+	y := 0.2126729*red + 0.7151522*green + 0.0721750*blue
+	z := (0.0193339*red + 0.1191920*green + 0.9503041*blue) / 1.08883
+	fx, fy, fz := lab_f(x), lab_f(y), lab_f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+func FromLab(l float64, a float64, b float64) MyCol {
+	fy := (l + 16) / 116
+	fx := fy + a/500
+	fz := fy - b/200
+	x := 0.95047 * lab_f_inverse(fx)
+	y := lab_f_inverse(fy)
+	z := 1.08883 * lab_f_inverse(fz)
+	red := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	green := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	blue := 0.0556434*x - 0.2040259*y + 1.0572252*z
+	return from_unit(linear_to_srgb(red), linear_to_srgb(green), linear_to_srgb(blue))
+}
+
+func (col MyCol) Analogous(degrees float64) MyCol {
+	// A softened neighbour of col around the colour wheel
+	hue, saturation, lightness := col.ToHSL()
+	return FromHSL(hue+degrees, saturation*0.5, lightness).WithLightness(matt_lightness)
+}
+
+func (col MyCol) Muted() MyCol {
+	// col itself, greyed and darkened so it doesn't compete with the photos
+	hue, saturation, lightness := col.ToHSL()
+	return FromHSL(hue, saturation*0.35, lightness).WithLightness(matt_lightness)
+}
+
+func NeutralGrey() MyCol {
+	return FromLab(matt_lightness, 0, 0)
+}
+
+func (col MyCol) WithLightness(lightness float64) MyCol {
+	// col with its CIELAB lightness changed, keeping its hue and chroma
+	_, a, b := col.ToLab()
+	return FromLab(lightness, a, b)
+}
+
+func ParseHexColour(text string) (MyCol, error) {
+	// #rrggbb, the # being optional as it's awkward in a URL
+	text = strings.TrimPrefix(text, "#")
+	if len(text) != 6 {
+		return MyCol{}, errors.New("colour must be #rrggbb")
+	}
+	value, err := strconv.ParseUint(text, 16, 32)
+	if err != nil {
+		return MyCol{}, errors.New("colour must be #rrggbb")
+	}
+	// Each 8 bit channel repeated to fill 16 bits, so ff is 0xffff
+	return MyCol{(value >> 16 & 0xff) * 0x101, (value >> 8 & 0xff) * 0x101, (value & 0xff) * 0x101}, nil
+}
+
+func (col MyCol) Hex() string {
+	rgba := col.GetRGBA()
+	return fmt.Sprintf("#%02x%02x%02x", rgba.R, rgba.G, rgba.B)
+}
+
+func (col MyCol) unit() (float64, float64, float64) {
+	return float64(col.Red) / 65535, float64(col.Green) / 65535, float64(col.Blue) / 65535
+}
+
+func from_unit(r float64, g float64, b float64) MyCol {
+	return MyCol{
+		uint64(math.Round(clamp_unit(r) * 65535)),
+		uint64(math.Round(clamp_unit(g) * 65535)),
+		uint64(math.Round(clamp_unit(b) * 65535)),
+	}
+}
+
+func clamp_unit(value float64) float64 {
+	return math.Max(0, math.Min(1, value))
+}
+
+func srgb_to_linear(value float64) float64 {
+	if value <= 0.04045 {
+		return value / 12.92
+	}
+	return math.Pow((value+0.055)/1.055, 2.4)
+}
+
+func linear_to_srgb(value float64) float64 {
+	if value <= 0.0031308 {
+		return value * 12.92
+	}
+	return 1.055*math.Pow(value, 1/2.4) - 0.055
+}
+
+func lab_f(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29
+}
+
+func lab_f_inverse(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta {
+		return t * t * t
+	}
+	return 3 * delta * delta * (t - 4.0/29)
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"html"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 
 	"os"
 
@@ -23,14 +25,24 @@ import (
 	"github.com/disintegration/imaging"
 	"github.com/nfnt/resize"
 
-	"path/filepath"
 	"strings"
+	"time"
 )
 
 var template_set *template.Template
 
 var live_count = 0
 
+var resize_cache *ResizeCache
+
+var photo_index *PhotoIndex
+
+var photo_selector *Selector
+
+var config Config
+
+var gazetteer *Gazetteer
+
 func Abs(x int32) int32 {
 	if x < 0 {
 		return -x
@@ -70,8 +82,17 @@ type CoG struct {
 // Data structure to represent the set of previously fetched image
 
 type SnapshotSet struct {
-	Snaps []*Snapshot `json:"snaps"`
-	Matt  MyCol       `json:"matt"`
+	Snaps   []*Snapshot    `json:"snaps"`
+	Matt    MyCol          `json:"matt"`
+	Metrics *LayoutMetrics `json:"metrics,omitempty"`
+
+	// The photos' colours combined, commonest first, and if asked for
+	// the colours of a gradient to use for the background instead of
+	// the plain matt, top left to bottom right
+	Palette  Palette `json:"palette,omitempty"`
+	Gradient []MyCol `json:"gradient,omitempty"`
+
+	target_aspect float64 // width/height of the window being packed for
 }
 
 func (snapset *SnapshotSet) append(snap Snapshot) {
@@ -140,8 +161,19 @@ func (snapset *SnapshotSet) possible_positions(snap *Snapshot) []Pair {
 }
 
 func (snapset *SnapshotSet) find_best_position(newsnap *Snapshot) Pair {
+	/*
+		Of the positions where newsnap doesn't overlap, prefers the one
+		leaving the smallest bounding box once that box is widened or
+		heightened to the target aspect ratio, as that is what will be
+		left after rescale_to_window. Ties go to whichever is closest to
+		the CoG, with distances across the short side of the canvas
+		weighted up so the set grows along the long side.
+	*/
+	aspect := snapset.aspect()
 	cog := snapset.get_CoG()
-	closest_distance := 1000000000
+	min_x, min_y, max_x, max_y := snapset.bounding_box()
+	smallest_area := math.Inf(1)
+	closest_distance := math.Inf(1)
 	positions := snapset.possible_positions(newsnap)
 	best_found_position := Pair{0, 0}
 
@@ -150,12 +182,19 @@ func (snapset *SnapshotSet) find_best_position(newsnap *Snapshot) Pair {
 		newsnap.Y = position.upper
 
 		if !snapset.overlaps(newsnap) {
-			// It doesn't overlap, so how close is it to the CoG
+			// It doesn't overlap, so how much window would it need
+			box_width := float64(max32(max_x, newsnap.X+newsnap.Width) - min32(min_x, newsnap.X))
+			box_height := float64(max32(max_y, newsnap.Y+newsnap.Height) - min32(min_y, newsnap.Y))
+			area := math.Max(box_width*box_width/aspect, box_height*box_height*aspect)
+
+			// and how close is it to the CoG
 			newone_cog := newsnap.get_CoG()
-			dx := cog.x - newone_cog.x
-			dy := cog.y - newone_cog.y
-			step_sqr := dx*dx + 2*dy*dy
-			if step_sqr < closest_distance {
+			dx := float64(cog.x - newone_cog.x)
+			dy := float64(cog.y - newone_cog.y)
+			step_sqr := dx*dx + dy*dy*aspect
+
+			if area < smallest_area || (area == smallest_area && step_sqr < closest_distance) {
+				smallest_area = area
 				closest_distance = step_sqr
 				best_found_position = position
 			}
@@ -166,6 +205,28 @@ func (snapset *SnapshotSet) find_best_position(newsnap *Snapshot) Pair {
 
 }
 
+func (snapset *SnapshotSet) aspect() float64 {
+	// The width/height ratio of the window the set is being fitted for
+	if snapset.target_aspect <= 0 {
+		return 16.0 / 9.0
+	}
+	return snapset.target_aspect
+}
+
+func min32(a int32, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a int32, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func (snapset *SnapshotSet) fit_another(newsnap *Snapshot) {
 	position := snapset.find_best_position(newsnap)
 	newsnap.X = position.lower
@@ -173,10 +234,11 @@ func (snapset *SnapshotSet) fit_another(newsnap *Snapshot) {
 	snapset.append(*newsnap)
 }
 
-func (snapset *SnapshotSet) rescale_to_window(width int, height int) {
+func (snapset *SnapshotSet) rescale_to_window(width int, height int) float64 {
 	// Once a set has been fitted
 	// This will adjust the set so that the result fits inside the width and height
 	// and is generally centred
+	// returning the gain it was scaled by
 
 	min_x := int32(1000000)
 	max_x := int32(-1000000)
@@ -220,17 +282,20 @@ func (snapset *SnapshotSet) rescale_to_window(width int, height int) {
 		snap.Height = int32(math.Floor(float64(gain) * float64(snap.Height)))
 
 	}
+	return float64(gain)
 
 }
 
 // Core data structure for a single photo
 
 type Snapshot struct {
-	Width    int32  `json:"width"`
-	Height   int32  `json:"height"`
-	X        int32  `json:"x"`
-	Y        int32  `json:"y"`
-	Location string `json:"location"`
+	Width    int32    `json:"width"`
+	Height   int32    `json:"height"`
+	X        int32    `json:"x"`
+	Y        int32    `json:"y"`
+	Location string   `json:"location"`
+	Border   int32    `json:"border,omitempty"` // frame drawn inside the box, included in Width & Height
+	Caption  *Caption `json:"caption,omitempty"`
 }
 
 func (snap *Snapshot) get_positions(other *Snapshot) []Pair {
@@ -433,7 +498,7 @@ func make_random_snapshot() *Snapshot {
 	height := 60 + rand.Int31n(100)
 	x := 250 + rand.Int31n(500-width)
 	y := 250 + rand.Int31n(500-height)
-	return &Snapshot{width, height, x, y, "random"}
+	return &Snapshot{width, height, x, y, "random", 0, nil}
 }
 
 func draw_CoG(img *image.RGBA, cog CoG) {
@@ -494,16 +559,20 @@ var (
 
 func test_layout_handler(w http.ResponseWriter, r *http.Request) {
 
-	image_filenames, err := fetch_local_image_filenames("photos/")
+	image_filenames, err := photo_selector.choose(photo_index, PhotoFilter{})
+	if err == no_photos {
+		http.Error(w, "No photos to lay out", 404)
+		return
+	}
 	if err != nil {
-		log.Fatal("Couldn't fetch the image filenames")
+		log.Printf("Couldn't fetch the image filenames: %v\n", err)
 		http.Error(w, "Couldn't fetch the image filenames", 500)
 		return
 	}
 
-	snapshots, err := snapshots_from_local_filenames(image_filenames, "photos/")
+	snapshots, err := snapshots_from_local_filenames(image_filenames, photo_index)
 	if err != nil {
-		log.Fatal("Couldn't fetch the snapshots")
+		log.Printf("Couldn't fetch the snapshots: %v\n", err)
 		http.Error(w, "Couldn't fetch the snapshots", 500)
 		return
 	}
@@ -519,7 +588,7 @@ func test_layout_handler(w http.ResponseWriter, r *http.Request) {
 		image.Point{},
 		draw.Src)
 
-	snap_set := SnapshotSet{}
+	snap_set := SnapshotSet{target_aspect: 1200.0 / 800.0}
 
 	// Initial rectangle
 
@@ -604,26 +673,119 @@ func compositeMapHandler(response http.ResponseWriter, request *http.Request) {
 			{"width":364,"height":273,"x":1248,"y":716,"location":"IMGP0972.JPG"}
 			]}
 	*/
+	snap_set, _, ok := composite_for_request(response, request)
+	if !ok {
+		return
+	}
+
+	// make the json
+
+	jsonset, err := json.Marshal(snap_set)
+
+	if err != nil {
+		log.Fatalf("Failed to jsonise:\n\t%v\n\t%v\n", snap_set, err)
+	}
+	http.ResponseWriter.Header(response).Set("Content-Type", "application/json")
+	response.Write(jsonset)
+
+}
+
+func composite_for_request(response http.ResponseWriter, request *http.Request) (SnapshotSet, Canvas, bool) {
+	/*
+		Chooses the photos and lays them out on the canvas described by
+		the request's parameters, as shared by the json map and the
+		server side rendering. If anything is wrong the error has
+		already been written to response and ok is false.
+	*/
 	height, err := strconv.Atoi(request.URL.Query().Get("height"))
 	if err != nil {
 		http.Error(response, "Missing height parameter", 400)
-		return
+		return SnapshotSet{}, Canvas{}, false
 	}
 	width, err := strconv.Atoi(request.URL.Query().Get("width"))
 	if err != nil {
 		http.Error(response, "missing width parameter", 400)
-		return
+		return SnapshotSet{}, Canvas{}, false
+	}
+	if width < 10 || width > 4000 || height < 10 || height > 4000 {
+		http.Error(response, "width and height must be between 10 and 4000", 400)
+		return SnapshotSet{}, Canvas{}, false
 	}
 
-	log.Printf("Found in request for composite data:\n\tHeight: %v\n\tWidth: %v\n", height, width)
+	layout_name := request.URL.Query().Get("layout")
+	if layout_name == "" {
+		layout_name = default_layout
+	}
+	layout, found := layouts[layout_name]
+	if !found {
+		http.Error(response, fmt.Sprintf("Unknown layout, must be one of %v", layout_names()), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+
+	gutter, err := optional_int_parameter(request, "gutter", 0, 0, 200)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+	border, err := optional_int_parameter(request, "border", 0, 0, 100)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+	// How far, as a percentage, photos can be cropped to fill the gaps
+	crop, err := optional_int_parameter(request, "crop", 20, 0, 50)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+	canvas := Canvas{Width: width, Height: height, Gutter: gutter, Border: border, CropTolerance: float64(crop) / 100}
+	if err := canvas.check_room(); err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+	matt_name := request.URL.Query().Get("matt")
+	if matt_name == "" {
+		matt_name = config.Matt.Strategy
+	}
+	matt, err := matt_strategy(matt_name)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+	background := request.URL.Query().Get("background")
+	if background == "" {
+		background = config.Matt.Background
+	}
+	if err := check_background(background); err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+	captions, err := optional_bool_parameter(request, "captions", config.Captions.Show)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
+
+	log.Printf("Found in request for composite data:\n\tHeight: %v\n\tWidth: %v\n\tLayout: %v\n\tGutter: %v\n\tBorder: %v\n\tCrop: %v%%\n", height, width, layout_name, gutter, border, crop)
+
+	// Pinned to particular albums, or dates?
+	filter, err := photo_filter_from_request(request)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return SnapshotSet{}, Canvas{}, false
+	}
 
 	// Fetch the list of images, and setup list of snapshots to be fitted
 
-	image_filenames, err := fetch_local_image_filenames("photos/")
+	image_filenames, err := photo_selector.choose(photo_index, filter)
+	if err == no_photos {
+		http.Error(response, fmt.Sprintf("No photos taken %v", filter), 404)
+		return SnapshotSet{}, Canvas{}, false
+	}
 	if err != nil {
-		log.Fatal("Couldn't fetch the image filenames")
+		log.Printf("Couldn't fetch the image filenames: %v\n", err)
 		http.Error(response, "Couldn't fetch the image filenames", 500)
-		return
+		return SnapshotSet{}, Canvas{}, false
 	}
 
 	// At this point we just have a list of filenames
@@ -631,55 +793,25 @@ func compositeMapHandler(response http.ResponseWriter, request *http.Request) {
 	// so first all of the Snapshots for those images
 	// are retreived...
 
-	snapshots, err := snapshots_from_local_filenames(image_filenames, "photos/")
+	snapshots, err := snapshots_from_local_filenames(image_filenames, photo_index)
 	if err != nil {
-		log.Fatal("Couldn't fetch the snapshots")
+		log.Printf("Couldn't fetch the snapshots: %v\n", err)
 		http.Error(response, "Couldn't fetch the snapshots", 500)
-		return
+		return SnapshotSet{}, Canvas{}, false
 	}
 
 	log.Print(snapshots)
 
-	// Create the snapshotset with all of the images placed
-	// On to a theoretical huge canvas 5000x5000
-
-	snap_set := SnapshotSet{}
-
-	//Place the first in the middle of that field
-	first_img := snapshots[0]
-	first_img.X = 5000 - first_img.Width/2
-	first_img.Y = 5000 - first_img.Height/2
-	snap_set.append(first_img)
-
-	// Calculate matt color from the first image
-	col, err := get_matt_color("photos/" + first_img.Location)
-
-	fmt.Printf("Matt color: %v\n", col)
-
-	if err != nil {
-		log.Fatal("Couldn't get the matt color")
-		http.Error(response, "Couldn't get the matt color", 500)
-		return
+	// Place them all on the window
+	snap_set := layout.place(snapshots, canvas)
+	if len(snap_set.Snaps) == 0 {
+		http.Error(response, "No room for the photos on the canvas with that gutter and border", 400)
+		return SnapshotSet{}, Canvas{}, false
 	}
-
-	snap_set.Matt = col
-
-	// Now add some more to minimise gravity
-
-	for i := 1; i < len(snapshots); i++ {
-		//cog := snap_set.get_CoG()
-		//log.Printf("Cog: %v\n", cog)
-
-		another_img := snapshots[i]
-		snap_set.fit_another(&another_img)
-
+	if len(snap_set.Snaps) > 1 && canvas.CropTolerance > 0 {
+		fill_gaps(&snap_set, canvas)
 	}
 
-	// rescale to the window
-	// trims the space around the large compositing canvas
-	// If the image is a singleton
-	snap_set.rescale_to_window(width, height)
-
 	// Deal with the special case of a single image
 	// by resizing it inwards to suit...
 	if len(snap_set.Snaps) == 1 {
@@ -687,19 +819,56 @@ func compositeMapHandler(response http.ResponseWriter, request *http.Request) {
 		resized := adjust_image_for_matt(width, height, *snap_set.Snaps[0])
 		snap_set = SnapshotSet{}
 		snap_set.append(resized)
-		snap_set.Matt = col
 	}
 
-	// make the json
+	// Matt colour from all the photos, as big as they're shown
+	snap_set.Matt = composite_matt(&snap_set, matt)
+	fmt.Printf("Matt color: %v\n", snap_set.Matt)
+	if background == "gradient" {
+		snap_set.Gradient = matt_gradient(snap_set.Palette, snap_set.Matt, matt)
+	}
 
-	jsonset, err := json.Marshal(snap_set)
+	if captions {
+		add_captions(&snap_set)
+	}
 
-	if err != nil {
-		log.Fatalf("Failed to jsonise:\n\t%v\n\t%v\n", snap_set, err)
+	metrics := measure_layout(&snap_set, snapshots, width, height)
+	snap_set.Metrics = &metrics
+
+	return snap_set, canvas, true
+}
+
+func optional_int_parameter(request *http.Request, name string, default_value int, min int, max int) (int, error) {
+	// Reads the integer query parameter name, which must lie in min..max
+	// giving default_value if it isn't there at all
+	text := request.URL.Query().Get(name)
+	if text == "" {
+		return default_value, nil
 	}
-	http.ResponseWriter.Header(response).Set("Content-Type", "application/json")
-	response.Write(jsonset)
+	value, err := strconv.Atoi(text)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("%s must be a whole number between %d and %d", name, min, max)
+	}
+	return value, nil
+}
 
+func optional_bool_parameter(request *http.Request, name string, default_value bool) (bool, error) {
+	// Reads the query parameter name as true/false, 1/0 or on/off
+	// giving default_value if it isn't there at all
+	text := request.URL.Query().Get(name)
+	switch text {
+	case "":
+		return default_value, nil
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	value, err := strconv.ParseBool(text)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+	return value, nil
 }
 
 func compositePageHandler(response http.ResponseWriter, request *http.Request) {
@@ -722,79 +891,60 @@ func compositePageHandler(response http.ResponseWriter, request *http.Request) {
 
 func homeHandler(response http.ResponseWriter, request *http.Request) {
 	response.Write([]byte(`<a href="/composite_page">Composite Page</a>`))
+	response.Write([]byte(`<br><a href="/composite_page/?mode=onthisday">On This Day</a>`))
 
-}
-
-func fetch_local_image_filenames(image_path string) ([]string, error) {
-	/*
-		Fetches the filenames of a random number of images
-		to be used to build the map for the page
-		returning a slice of strings
-		image_path is a string that points to a directory
-		containing images
-		only files with endings congruent with jpegs are considered
-
-	*/
-	all_image_filenames, err := filepath.Glob(image_path + "*.[jJ][pP][gG]")
-	if err != nil {
-		return nil, err
-	}
-
-	// We only want the filename from the whole thing
-	for i, filename := range all_image_filenames {
-		all_image_filenames[i] = filepath.Base(filename)
-
-	}
-	log.Printf("Found %v images to consider\nFirst is : %v\n", len(all_image_filenames), all_image_filenames[0])
-
-	// choose quantity, we want this to be very non-linear!
-	image_count := 0
-
-	if rand.Intn(100) < 90 {
-		image_count = 1
-	} else {
-		image_count = rand.Intn(9) + 5
-	}
-
-	// image_count := rand.Intn(30) + 1
-	// if image_count > 12 {
-	// 	image_count = 1
-	// }
-
-	image_set := make([]string, 0, image_count)
-	image_indexes := make(map[int]bool)
-
-	for {
-		// Are we done
-		if len(image_set) == image_count {
-			break
+	// and one pinned to each album
+	for _, album := range photo_index.albums() {
+		if album == "" {
+			continue
 		}
-		// Try and add one
-		index := rand.Intn(len(all_image_filenames))
-		if !image_indexes[index] {
-			image_indexes[index] = true
-			new_image := all_image_filenames[index]
-			image_set = append(image_set, new_image)
-		}
-
+		link := "/composite_page/?album=" + url.QueryEscape(album)
+		fmt.Fprintf(response, `<br><a href="%s">%s</a>`, html.EscapeString(link), html.EscapeString(album))
 	}
-	log.Printf("Found image set filenames: %v\n", image_set)
-	return image_set, nil
+
 }
 
 func fetch_image_from_file(filepath string, filename string) (image.Image, error) {
+	// Any of the photo_extensions, the first frame if it's animated,
+	// and anything transparent flattened on to white as jpegs can't be,
+	// then rotated and cropped as its notes say
 	img, err := imaging.Open(filepath+filename, imaging.AutoOrientation(true))
-
-	return img, err
+	if err != nil {
+		return nil, err
+	}
+	notes, _ := load_notes(filepath, filename)
+	img = notes.apply(img, filename)
+
+	if transparent, ok := img.(interface{ Opaque() bool }); ok && !transparent.Opaque() {
+		flattened := image.NewRGBA(img.Bounds())
+		draw.Draw(flattened, flattened.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flattened
+	}
+	return img, nil
 }
 
-func fetch_and_resize_image_from_file(filepath string, filename string, width int) (image.Image, error) {
+func fetch_and_resize_image_from_file(filepath string, filename string, width int, height int) (image.Image, error) {
+	// Keeping its shape if height is 0, otherwise cropped to width x height
 	img, err := fetch_image_from_file(filepath, filename)
 
 	if err != nil {
 		return nil, err
 	}
-	resized := resize.Resize(uint(width), 0, img, resize.Bilinear)
+	if height > 0 {
+		// Never upscale, just make it the right shape
+		shrink := math.Min(float64(img.Bounds().Dx())/float64(width), float64(img.Bounds().Dy())/float64(height))
+		if shrink < 1 {
+			width = max_int(1, int(float64(width)*shrink))
+			height = max_int(1, int(float64(height)*shrink))
+		}
+		return smart_crop(img, width, height, faces_of(filename)), nil
+	}
+	// Never upscale, the browser can do that just as well from fewer bytes
+	if width > img.Bounds().Dx() {
+		width = img.Bounds().Dx()
+	}
+	resized := resize.Resize(uint(width), 0, img, resize.Lanczos3)
 	return resized, nil
 
 }
@@ -842,7 +992,7 @@ func adjust_image_for_matt(canvas_width int, canvas_height int, original Snapsho
 
 	x := int32((canvas_width - new_width) / 2)
 	y := int32((canvas_height - new_height) / 2)
-	new_snap := Snapshot{int32(new_width), int32(new_height), x, y, original.Location}
+	new_snap := Snapshot{int32(new_width), int32(new_height), x, y, original.Location, original.Border, original.Caption}
 	fmt.Println("Allowing for matt snapshot is : ", new_snap)
 
 	return new_snap
@@ -864,54 +1014,53 @@ func photoHandler(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	img, err := fetch_image_from_file("photos/", filename)
+	// Cropped to fit a box this high, if given, rather than keeping its shape
+	height, err := optional_int_parameter(request, "height", 0, 10, 4000)
 	if err != nil {
-		http.Error(response, "Couldn't find the requested image", 400)
+		http.Error(response, err.Error(), 400)
 		return
 	}
-	response.Header().Set("Content-Type", "image/jpeg")
-	jpeg.Encode(response, img, nil)
 
-}
-
-func snapshot_from_jpeg_file(filename string, filepath string) (Snapshot, error) {
-	// file, err := os.Open(filepath + filename)
-
-	// if err != nil {
-	// 	log.Printf("Failed to load : %v\nErr:%v\n", filename, err)
-	// 	return Snapshot{}, err
-	// }
-	// defer file.Close()
-
-	// img, err := jpeg.Decode(file)
+	// Only what's in the index, so nothing outside photos/ can be asked for
+	if _, err := photo_index.lookup(filename); err != nil {
+		http.Error(response, "Couldn't find the requested image", 404)
+		return
+	}
 
-	img, err := fetch_image_from_file(filepath, filename)
+	response.Header().Set("Vary", "Accept")
+	format, err := choose_tile_format(request, filename, width)
+	if err == not_acceptable {
+		http.Error(response, err.Error(), 406)
+		return
+	}
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return
+	}
 
+	encoded, err := resize_cache.fetch("photos/", filename, width, height, format)
 	if err != nil {
-		log.Printf("Failed to decode the image: %v\n", filename)
-		return Snapshot{}, err
+		http.Error(response, "Couldn't find the requested image", 400)
+		return
 	}
-	res := Snapshot{
-		X:        0,
-		Y:        0,
-		Width:    int32(img.Bounds().Dx()),
-		Height:   int32(img.Bounds().Dy()),
-		Location: filename,
+	response.Header().Set("Content-Type", format.content_type())
+	response.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+	if _, err := response.Write(encoded); err != nil {
+		log.Println("unable to write image.")
 	}
-	return res, nil // comment
 
 }
 
-func snapshots_from_local_filenames(filenames []string, filepath string) ([]Snapshot, error) {
+func snapshots_from_local_filenames(filenames []string, index *PhotoIndex) ([]Snapshot, error) {
 	snaps := make([]Snapshot, 0, len(filenames))
 	for _, filename := range filenames {
-		snap, err := snapshot_from_jpeg_file(filename, filepath)
+		record, err := index.lookup(filename)
 
 		if err != nil {
 			log.Printf("IGNORING BAD FILE: %v\n", filename)
 
 		} else {
-			snaps = append(snaps, snap)
+			snaps = append(snaps, record.snapshot())
 		}
 	}
 	return snaps, nil
@@ -920,15 +1069,7 @@ func snapshots_from_local_filenames(filenames []string, filepath string) ([]Snap
 // var random *rand.Rand
 
 func Check_all_images(path string) (goods []string, bads []string) {
-	filenames, err := filepath.Glob(path + "*.jpg")
-	if err != nil {
-		log.Fatal(err)
-	}
-	for i, filename := range filenames {
-		filenames[i] = filepath.Base(filename)
-
-	}
-
+	filenames, err := find_photos(path)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -987,6 +1128,23 @@ func main() {
 
 	fmt.Printf("Template set loaded: %s \n", template_set.DefinedTemplates())
 
+	config = load_config("config.json")
+
+	gazetteer = load_gazetteer(config.Captions.GazetteerFile)
+
+	resize_cache = NewResizeCache("photo_cache", 500, 128<<20, 512<<20)
+
+	photo_index = NewPhotoIndex("photo_index.json", "photos/")
+	// Following before the first refresh, so whatever changed or went
+	// while the server was stopped is cleared from the cache and history
+	go resize_cache.follow(photo_index.subscribe())
+	photo_selector = NewSelector(config.Selection, "show_history.json")
+	go photo_selector.follow(photo_index.subscribe())
+	if err := photo_index.refresh(); err != nil {
+		log.Fatalf("Couldn't index the photos: %v", err)
+	}
+	photo_index.watch(10 * time.Minute)
+
 	// template_filename := "view" + ".html"
 	// fmt.Printf("Template filename : %s\n", template_filename)
 
@@ -1021,8 +1179,14 @@ func main() {
 
 	http.HandleFunc("/composite_page/", compositePageHandler)
 
+	http.HandleFunc("/composite.jpg", compositeImageHandler)
+
+	http.HandleFunc("/composite.png", compositeImageHandler)
+
 	http.HandleFunc("/photograph/", photoHandler)
 
+	http.HandleFunc("/debug/matt/", mattDebugHandler)
+
 	http.HandleFunc("/", homeHandler)
 
 	fmt.Println("Starting server on port 8080")
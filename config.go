@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// Server settings, read from config.json at startup. Anything missing
+// from the file, or the whole file, falls back to the defaults below.
+
+type Config struct {
+	Selection SelectionConfig `json:"selection"`
+	Captions  CaptionConfig   `json:"captions"`
+	Faces     FaceConfig      `json:"faces"`
+	Matt      MattConfig      `json:"matt"`
+}
+
+type SelectionConfig struct {
+	// Relative chance of each number of photos in a composite
+	CountWeights map[int]float64 `json:"count_weights"`
+
+	// Photos, or whole albums, to show more often than the rest
+	Favourites      []string `json:"favourites"`
+	FavouriteWeight float64  `json:"favourite_weight"`
+
+	// Photos added to the library in the last NewDays days
+	NewDays   int     `json:"new_days"`
+	NewWeight float64 `json:"new_weight"`
+
+	// How strongly to favour photos shown fewer times than average,
+	// 0 ignores how often they've been shown (beyond not repeating
+	// any until everything has had a turn)
+	RarityBoost float64 `json:"rarity_boost"`
+
+	// Composites of several photos are drawn from a single event, which
+	// ends when there's a gap of more than EventGapHours between photos
+	// or they were taken more than EventDistanceKm apart
+	EventGapHours   float64 `json:"event_gap_hours"`
+	EventDistanceKm float64 `json:"event_distance_km"`
+}
+
+type CaptionConfig struct {
+	// Whether to caption photos when ?captions= isn't given
+	Show bool `json:"show"`
+
+	// GeoNames dump used to name the places photos were taken, and how
+	// far a photo can be from a place to be named after it
+	GazetteerFile   string  `json:"gazetteer_file"`
+	PlaceDistanceKm float64 `json:"place_distance_km"`
+}
+
+type FaceConfig struct {
+	// pigo's facefinder cascade, faces aren't looked for without it
+	CascadeFile string `json:"cascade_file"`
+}
+
+type MattConfig struct {
+	// complement, analogous, muted-dominant, neutral-grey or a colour
+	// #rrggbb, when ?matt= isn't given
+	Strategy string `json:"strategy"`
+	// plain or gradient, when ?background= isn't given
+	Background string `json:"background"`
+}
+
+func default_config() Config {
+	// A single photo nine times in ten, otherwise anything from 5 to 13
+	count_weights := map[int]float64{1: 90}
+	for count := 5; count <= 13; count++ {
+		count_weights[count] = 10.0 / 9.0
+	}
+	return Config{
+		Selection: SelectionConfig{
+			CountWeights:    count_weights,
+			Favourites:      []string{},
+			FavouriteWeight: 3,
+			NewDays:         30,
+			NewWeight:       2,
+			RarityBoost:     1,
+			EventGapHours:   6,
+			EventDistanceKm: 50,
+		},
+		Captions: CaptionConfig{
+			Show:            false,
+			GazetteerFile:   "gazetteer.txt",
+			PlaceDistanceKm: 25,
+		},
+		Faces: FaceConfig{
+			CascadeFile: "cascade/facefinder",
+		},
+		Matt: MattConfig{
+			Strategy:   "complement",
+			Background: "plain",
+		},
+	}
+}
+
+func load_config(filename string) Config {
+	config := default_config()
+	saved, err := os.ReadFile(filename)
+	if err != nil {
+		log.Printf("No %v, using the default settings: %v\n", filename, err)
+		return config
+	}
+	// Replace rather than merge the default count weights if given
+	config.Selection.CountWeights = nil
+	if err := json.Unmarshal(saved, &config); err != nil {
+		log.Fatalf("Couldn't read %v: %v", filename, err)
+	}
+	if len(config.Selection.CountWeights) == 0 {
+		config.Selection.CountWeights = default_config().Selection.CountWeights
+	}
+	if _, err := matt_strategy(config.Matt.Strategy); err != nil {
+		log.Fatalf("Bad matt strategy in %v: %v", filename, err)
+	}
+	if err := check_background(config.Matt.Background); err != nil {
+		log.Fatalf("Bad matt background in %v: %v", filename, err)
+	}
+	return config
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Groups photos into events, so a composite of several photos can be
+// drawn from just one of them and tell one story. Going through the
+// photos in the order they were taken, a new event starts whenever
+// there's a long enough gap between one photo and the next, or the
+// photos were taken far enough apart (when both have a GPS position).
+// Photos with no known date can't be placed in time, so they're
+// grouped by album instead.
+
+func group_into_events(records []PhotoRecord, gap time.Duration, distance_km float64) [][]int {
+	// The indices into records of the photos in each event
+	dated := make([]int, 0, len(records))
+	undated := make(map[string][]int)
+	for i, record := range records {
+		if record.Taken.IsZero() {
+			undated[record.Album] = append(undated[record.Album], i)
+		} else {
+			dated = append(dated, i)
+		}
+	}
+	sort.SliceStable(dated, func(i, j int) bool {
+		return records[dated[i]].Taken.Before(records[dated[j]].Taken)
+	})
+
+	events := make([][]int, 0)
+	var event []int
+	var last_taken time.Time
+	var last_place *GeoPoint // of the event so far, photos without GPS don't move it
+	for _, i := range dated {
+		record := records[i]
+		moved := last_place != nil && record.GPS != nil && distance_between(*last_place, *record.GPS) > distance_km
+		if event != nil && (record.Taken.Sub(last_taken) > gap || moved) {
+			events = append(events, event)
+			event = nil
+			last_place = nil
+		}
+		event = append(event, i)
+		last_taken = record.Taken
+		if record.GPS != nil {
+			last_place = record.GPS
+		}
+	}
+	if event != nil {
+		events = append(events, event)
+	}
+
+	albums := make([]string, 0, len(undated))
+	for album := range undated {
+		albums = append(albums, album)
+	}
+	sort.Strings(albums)
+	for _, album := range albums {
+		events = append(events, undated[album])
+	}
+	return events
+}
+
+func distance_between(a GeoPoint, b GeoPoint) float64 {
+	// Great circle distance in km
+	const earth_radius_km = 6371.0
+	radians := math.Pi / 180
+	d_latitude := (b.Latitude - a.Latitude) * radians
+	d_longitude := (b.Longitude - a.Longitude) * radians
+	h := math.Pow(math.Sin(d_latitude/2), 2) +
+		math.Cos(a.Latitude*radians)*math.Cos(b.Latitude*radians)*math.Pow(math.Sin(d_longitude/2), 2)
+	return 2 * earth_radius_km * math.Asin(math.Min(1, math.Sqrt(h)))
+}
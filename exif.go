@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Just enough of an EXIF reader to get at the tags we use, from jpegs
+// (the APP1 segment) and tiffs (which are EXIF's own format). imaging
+// reads the orientation itself but doesn't expose anything else.
+
+const (
+	exif_tag_make               = 0x010F
+	exif_tag_model              = 0x0110
+	exif_tag_exif_ifd           = 0x8769
+	exif_tag_gps_ifd            = 0x8825
+	exif_tag_date_time_original = 0x9003
+	gps_tag_latitude_ref        = 1
+	gps_tag_latitude            = 2
+	gps_tag_longitude_ref       = 3
+	gps_tag_longitude           = 4
+)
+
+type ExifData struct {
+	Taken  time.Time // zero if not known
+	GPS    *GeoPoint // nil if not known
+	Camera string    // make and model, "" if not known
+}
+
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"` // degrees, north and east positive
+	Longitude float64 `json:"longitude"`
+}
+
+type exif_entry struct {
+	tag         uint16
+	kind        uint16
+	count       uint32
+	value_bytes []byte // the 4 byte value/offset field
+}
+
+type exif_reader struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+func read_exif(path string) (ExifData, error) {
+	tiff, err := find_tiff_header(path)
+	if err != nil {
+		return ExifData{}, err
+	}
+	return parse_exif(tiff)
+}
+
+func parse_exif(tiff []byte) (ExifData, error) {
+	reader, err := new_exif_reader(tiff)
+	if err != nil {
+		return ExifData{}, err
+	}
+
+	ifd0 := reader.ifd(reader.order.Uint32(tiff[4:8]))
+	exif := ExifData{Camera: camera_name(reader.ascii(ifd0[exif_tag_make]), reader.ascii(ifd0[exif_tag_model]))}
+	if pointer, found := ifd0[exif_tag_exif_ifd]; found {
+		exif_ifd := reader.ifd(reader.long(pointer))
+		if taken, found := exif_ifd[exif_tag_date_time_original]; found {
+			exif.Taken, _ = parse_exif_time(reader.ascii(taken))
+		}
+	}
+	if pointer, found := ifd0[exif_tag_gps_ifd]; found {
+		exif.GPS = reader.gps(reader.ifd(reader.long(pointer)))
+	}
+	return exif, nil
+}
+
+func (reader *exif_reader) gps(gps_ifd map[uint16]exif_entry) *GeoPoint {
+	// Latitude and longitude are each degrees, minutes and seconds,
+	// with a separate N/S or E/W
+	latitude, found := gps_ifd[gps_tag_latitude]
+	longitude, found_too := gps_ifd[gps_tag_longitude]
+	if !found || !found_too {
+		return nil
+	}
+	point := &GeoPoint{
+		Latitude:  degrees(reader.rationals(latitude)),
+		Longitude: degrees(reader.rationals(longitude)),
+	}
+	if math.IsNaN(point.Latitude) || math.IsNaN(point.Longitude) {
+		return nil
+	}
+	if reader.ascii(gps_ifd[gps_tag_latitude_ref]) == "S" {
+		point.Latitude = -point.Latitude
+	}
+	if reader.ascii(gps_ifd[gps_tag_longitude_ref]) == "W" {
+		point.Longitude = -point.Longitude
+	}
+	if point.Latitude == 0 && point.Longitude == 0 {
+		// What some cameras write when they haven't got a fix
+		return nil
+	}
+	return point
+}
+
+func camera_name(maker string, model string) string {
+	// Most models already start with the make e.g. "Canon EOS 5D",
+	// though not all e.g. "SM-G991B" from "samsung"
+	maker = strings.TrimSpace(maker)
+	model = strings.TrimSpace(model)
+	if maker == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(strings.Fields(maker)[0])) {
+		return model
+	}
+	if model == "" {
+		return maker
+	}
+	return maker + " " + model
+}
+
+func degrees(parts []float64) float64 {
+	if len(parts) != 3 {
+		return math.NaN()
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600
+}
+
+func find_tiff_header(path string) ([]byte, error) {
+	// The EXIF block, which starts with a tiff header
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension == ".tif" || extension == ".tiff" {
+		return io.ReadAll(file)
+	}
+
+	// The EXIF segment comes before the image data, and can't be more
+	// than 64k, so there's no need to read the whole jpeg
+	head := make([]byte, 256*1024)
+	length, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return exif_segment(head[:length])
+}
+
+func exif_segment(head []byte) ([]byte, error) {
+	// The EXIF block from the start of a jpeg, going from segment to
+	// segment until the image data
+	if len(head) < 4 || head[0] != 0xFF || head[1] != 0xD8 {
+		return nil, errors.New("not a jpeg")
+	}
+	for at := 2; at+4 <= len(head); {
+		if head[at] != 0xFF {
+			return nil, errors.New("lost track of the jpeg segments")
+		}
+		marker := head[at+1]
+		segment_length := int(binary.BigEndian.Uint16(head[at+2 : at+4]))
+		if marker == 0xDA {
+			// Start of the image data, so there's no EXIF
+			break
+		}
+		if segment_length < 2 {
+			// The length includes its own two bytes
+			return nil, errors.New("jpeg segment too short")
+		}
+		segment := head[at+4 : min_int(at+2+segment_length, len(head))]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		at += 2 + segment_length
+	}
+	return nil, errors.New("no EXIF")
+}
+
+func new_exif_reader(tiff []byte) (*exif_reader, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("EXIF too short")
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return &exif_reader{tiff, binary.LittleEndian}, nil
+	case "MM":
+		return &exif_reader{tiff, binary.BigEndian}, nil
+	}
+	return nil, errors.New("EXIF has no byte order")
+}
+
+func (reader *exif_reader) ifd(offset uint32) map[uint16]exif_entry {
+	// The entries of the image file directory at offset, by tag,
+	// stopping quietly at anything that runs off the end
+	entries := make(map[uint16]exif_entry)
+	if int(offset)+2 > len(reader.tiff) {
+		return entries
+	}
+	count := int(reader.order.Uint16(reader.tiff[offset:]))
+	for i := 0; i < count; i++ {
+		at := int(offset) + 2 + i*12
+		if at+12 > len(reader.tiff) {
+			break
+		}
+		entry := exif_entry{
+			tag:         reader.order.Uint16(reader.tiff[at:]),
+			kind:        reader.order.Uint16(reader.tiff[at+2:]),
+			count:       reader.order.Uint32(reader.tiff[at+4:]),
+			value_bytes: reader.tiff[at+8 : at+12],
+		}
+		entries[entry.tag] = entry
+	}
+	return entries
+}
+
+func (reader *exif_reader) long(entry exif_entry) uint32 {
+	return reader.order.Uint32(entry.value_bytes)
+}
+
+func (reader *exif_reader) value(entry exif_entry, size int) []byte {
+	// The entry's data, held in the entry itself if it fits in 4 bytes
+	if size <= 4 {
+		return entry.value_bytes[:size]
+	}
+	offset := int(reader.long(entry))
+	if offset < 0 || offset+size > len(reader.tiff) {
+		return nil
+	}
+	return reader.tiff[offset : offset+size]
+}
+
+func (reader *exif_reader) rationals(entry exif_entry) []float64 {
+	// Unsigned rationals, each two longs, NaN where it's x/0
+	data := reader.value(entry, int(entry.count)*8)
+	if entry.kind != 5 || data == nil {
+		return nil
+	}
+	values := make([]float64, entry.count)
+	for i := range values {
+		numerator := reader.order.Uint32(data[i*8:])
+		denominator := reader.order.Uint32(data[i*8+4:])
+		values[i] = math.NaN()
+		if denominator != 0 {
+			values[i] = float64(numerator) / float64(denominator)
+		}
+	}
+	return values
+}
+
+func (reader *exif_reader) ascii(entry exif_entry) string {
+	text := reader.value(entry, int(entry.count))
+	return strings.TrimRight(string(text), "\x00 ")
+}
+
+func parse_exif_time(text string) (time.Time, error) {
+	// EXIF times have no zone, so they're kept as the camera's clock
+	// read, in UTC, so the date doesn't shift wherever the server is
+	return time.Parse("2006:01:02 15:04:05", text)
+}
+
+// Phones and many cameras name photos after when they were taken,
+// e.g. 20201005_124652.jpg, IMG_20201005_124652.jpg or PXL_20201005_124652123.jpg
+var filename_date = regexp.MustCompile(`(?:^|[^0-9])((?:19|20)[0-9]{2})([01][0-9])([0-3][0-9])[_-]?([0-2][0-9])([0-5][0-9])([0-5][0-9])`)
+
+func time_from_filename(filename string) (time.Time, bool) {
+	match := filename_date.FindStringSubmatch(filepath.Base(filename))
+	if match == nil {
+		return time.Time{}, false
+	}
+	taken, err := time.Parse("20060102150405", strings.Join(match[1:], ""))
+	return taken, err == nil
+}
+
+func min_int(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
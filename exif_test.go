@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Builds just enough of a tiff to hold the tags read_exif looks at
+
+type tiff_entry struct {
+	tag   uint16
+	kind  uint16 // 2 ascii, 4 long, 5 rational
+	count uint32
+	data  []byte
+}
+
+func ascii_entry(tag uint16, text string) tiff_entry {
+	data := append([]byte(text), 0)
+	return tiff_entry{tag, 2, uint32(len(data)), data}
+}
+
+func long_entry(order binary.ByteOrder, tag uint16, value int) tiff_entry {
+	data := make([]byte, 4)
+	order.PutUint32(data, uint32(value))
+	return tiff_entry{tag, 4, 1, data}
+}
+
+func rational_entry(order binary.ByteOrder, tag uint16, values ...[2]uint32) tiff_entry {
+	data := make([]byte, 8*len(values))
+	for i, value := range values {
+		order.PutUint32(data[i*8:], value[0])
+		order.PutUint32(data[i*8+4:], value[1])
+	}
+	return tiff_entry{tag, 5, uint32(len(values)), data}
+}
+
+func degrees_entry(order binary.ByteOrder, tag uint16, degrees uint32, minutes uint32, seconds_hundredths uint32) tiff_entry {
+	return rational_entry(order, tag, [2]uint32{degrees, 1}, [2]uint32{minutes, 1}, [2]uint32{seconds_hundredths, 100})
+}
+
+func ifd_size(entries []tiff_entry) int {
+	size := 2 + 12*len(entries) + 4
+	for _, entry := range entries {
+		if len(entry.data) > 4 {
+			size += len(entry.data)
+		}
+	}
+	return size
+}
+
+func append_ifd(tiff []byte, order binary.ByteOrder, entries []tiff_entry) []byte {
+	ifd := make([]byte, 2+12*len(entries)+4)
+	data_at := len(tiff) + len(ifd)
+	data := make([]byte, 0)
+	order.PutUint16(ifd, uint16(len(entries)))
+	for i, entry := range entries {
+		field := ifd[2+12*i:]
+		order.PutUint16(field, entry.tag)
+		order.PutUint16(field[2:], entry.kind)
+		order.PutUint32(field[4:], entry.count)
+		if len(entry.data) <= 4 {
+			copy(field[8:12], entry.data)
+		} else {
+			order.PutUint32(field[8:], uint32(data_at+len(data)))
+			data = append(data, entry.data...)
+		}
+	}
+	return append(append(tiff, ifd...), data...)
+}
+
+func build_tiff(order binary.ByteOrder, ifd0 []tiff_entry, exif_ifd []tiff_entry, gps_ifd []tiff_entry) []byte {
+	// IFD0 with pointers to whichever of the EXIF and GPS IFDs are given
+	pointers := 0
+	if exif_ifd != nil {
+		pointers++
+	}
+	if gps_ifd != nil {
+		pointers++
+	}
+	exif_at := 8 + ifd_size(ifd0) + 12*pointers
+	gps_at := exif_at
+	if exif_ifd != nil {
+		gps_at += ifd_size(exif_ifd)
+	}
+	ifd0 = append([]tiff_entry{}, ifd0...)
+	if exif_ifd != nil {
+		ifd0 = append(ifd0, long_entry(order, exif_tag_exif_ifd, exif_at))
+	}
+	if gps_ifd != nil {
+		ifd0 = append(ifd0, long_entry(order, exif_tag_gps_ifd, gps_at))
+	}
+
+	tiff := make([]byte, 8)
+	if order == binary.ByteOrder(binary.LittleEndian) {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	tiff = append_ifd(tiff, order, ifd0)
+	if exif_ifd != nil {
+		tiff = append_ifd(tiff, order, exif_ifd)
+	}
+	if gps_ifd != nil {
+		tiff = append_ifd(tiff, order, gps_ifd)
+	}
+	return tiff
+}
+
+func full_tiff(order binary.ByteOrder, latitude_ref string, longitude_ref string) []byte {
+	return build_tiff(order,
+		[]tiff_entry{ascii_entry(exif_tag_make, "Canon"), ascii_entry(exif_tag_model, "Canon EOS 5D")},
+		[]tiff_entry{ascii_entry(exif_tag_date_time_original, "2019:08:14 16:05:09")},
+		[]tiff_entry{
+			ascii_entry(gps_tag_latitude_ref, latitude_ref),
+			degrees_entry(order, gps_tag_latitude, 57, 30, 0),
+			ascii_entry(gps_tag_longitude_ref, longitude_ref),
+			degrees_entry(order, gps_tag_longitude, 6, 15, 0),
+		})
+}
+
+func TestParseExif(t *testing.T) {
+	le := binary.LittleEndian
+	be := binary.BigEndian
+	taken := time.Date(2019, 8, 14, 16, 5, 9, 0, time.UTC)
+	tests := []struct {
+		name    string
+		tiff    []byte
+		want    ExifData
+		wantErr bool
+	}{
+		{"little endian", full_tiff(le, "N", "W"), ExifData{taken, &GeoPoint{57.5, -6.25}, "Canon EOS 5D"}, false},
+		{"big endian", full_tiff(be, "N", "W"), ExifData{taken, &GeoPoint{57.5, -6.25}, "Canon EOS 5D"}, false},
+		{"south east", full_tiff(le, "S", "E"), ExifData{taken, &GeoPoint{-57.5, 6.25}, "Canon EOS 5D"}, false},
+		{"make not in model", build_tiff(le,
+			[]tiff_entry{ascii_entry(exif_tag_make, "samsung"), ascii_entry(exif_tag_model, "SM-G991B")}, nil, nil),
+			ExifData{Camera: "samsung SM-G991B"}, false},
+		{"make only", build_tiff(le, []tiff_entry{ascii_entry(exif_tag_make, "  FUJIFILM ")}, nil, nil),
+			ExifData{Camera: "FUJIFILM"}, false},
+		{"bad date", build_tiff(le, nil, []tiff_entry{ascii_entry(exif_tag_date_time_original, "0000:00:00 00:00:00")}, nil),
+			ExifData{}, false},
+		{"no gps fix", build_tiff(le, nil, nil, []tiff_entry{
+			degrees_entry(le, gps_tag_latitude, 0, 0, 0), degrees_entry(le, gps_tag_longitude, 0, 0, 0)}),
+			ExifData{}, false},
+		{"divide by zero", build_tiff(le, nil, nil, []tiff_entry{
+			rational_entry(le, gps_tag_latitude, [2]uint32{57, 0}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+			degrees_entry(le, gps_tag_longitude, 6, 15, 0)}),
+			ExifData{}, false},
+		{"gps not rationals", build_tiff(le, nil, nil, []tiff_entry{
+			long_entry(le, gps_tag_latitude, 57), degrees_entry(le, gps_tag_longitude, 6, 15, 0)}),
+			ExifData{}, false},
+		{"huge count", build_tiff(le, []tiff_entry{{exif_tag_make, 2, 0xFFFFFFFF, []byte{0, 0, 0, 0}}}, nil, nil),
+			ExifData{}, false},
+		{"ifd past the end", []byte{'I', 'I', 42, 0, 0xFF, 0xFF, 0, 0}, ExifData{}, false},
+		{"ifd runs off the end", []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 0xFF, 0xFF, 1, 1}, ExifData{}, false},
+		{"no byte order", []byte{'X', 'X', 42, 0, 8, 0, 0, 0}, ExifData{}, true},
+		{"too short", []byte{'I', 'I', 42}, ExifData{}, true},
+	}
+	for _, test := range tests {
+		got, err := parse_exif(test.tiff)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: error %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !got.Taken.Equal(test.want.Taken) || got.Camera != test.want.Camera {
+			t.Errorf("%v: got %+v, want %+v", test.name, got, test.want)
+		}
+		if (got.GPS == nil) != (test.want.GPS == nil) || (got.GPS != nil && *got.GPS != *test.want.GPS) {
+			t.Errorf("%v: GPS %+v, want %+v", test.name, got.GPS, test.want.GPS)
+		}
+	}
+}
+
+func TestParseExifTruncated(t *testing.T) {
+	// Cut short anywhere, it should give up rather than panic
+	tiff := full_tiff(binary.LittleEndian, "N", "W")
+	for length := range tiff {
+		parse_exif(tiff[:length])
+	}
+}
+
+func jpeg_segment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func TestExifSegment(t *testing.T) {
+	tiff := full_tiff(binary.LittleEndian, "N", "W")
+	exif := jpeg_segment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+	jfif := jpeg_segment(0xE0, []byte("JFIF\x00\x01\x01"))
+	xmp := jpeg_segment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x/>"))
+	start := []byte{0xFF, 0xD8}
+	image_data := []byte{0xFF, 0xDA, 0x00, 0x02, 0x12, 0x34}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name    string
+		head    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"exif first", join(start, exif, image_data), tiff, false},
+		{"after jfif and xmp", join(start, jfif, xmp, exif, image_data), tiff, false},
+		{"no exif", join(start, jfif, image_data), nil, true},
+		{"not a jpeg", join([]byte{0x89, 'P', 'N', 'G'}, exif), nil, true},
+		{"empty", nil, nil, true},
+		{"lost track", join(start, jfif, []byte{0x00, 0xE1, 0x00, 0x10}), nil, true},
+		{"zero length segment", join(start, []byte{0xFF, 0xE1, 0x00, 0x00}, exif), nil, true},
+		{"one byte segment", join(start, []byte{0xFF, 0xE1, 0x00, 0x01}, exif), nil, true},
+		{"empty segment", join(start, []byte{0xFF, 0xE0, 0x00, 0x02}, exif), tiff, false},
+		{"cut short", join(start, jfif)[:10], nil, true},
+	}
+	for _, test := range tests {
+		got, err := exif_segment(test.head)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: error %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%v: got %d bytes, want %d", test.name, len(got), len(test.want))
+		}
+	}
+
+	// Cut short anywhere, it should give up rather than panic
+	whole := join(start, jfif, exif, image_data)
+	for length := range whole {
+		exif_segment(whole[:length])
+	}
+}
+
+func TestTimeFromFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     time.Time
+		found    bool
+	}{
+		{"20201005_124652.jpg", time.Date(2020, 10, 5, 12, 46, 52, 0, time.UTC), true},
+		{"2019/Skye/IMG_20190814-160509.jpg", time.Date(2019, 8, 14, 16, 5, 9, 0, time.UTC), true},
+		{"PXL_20201005_124652123.jpg", time.Date(2020, 10, 5, 12, 46, 52, 0, time.UTC), true},
+		{"IMG_0042.jpg", time.Time{}, false},
+		{"20201345_124652.jpg", time.Time{}, false},
+		{"120201005_124652.jpg", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, found := time_from_filename(test.filename)
+		if found != test.found || !got.Equal(test.want) {
+			t.Errorf("%v: got %v %v, want %v %v", test.filename, got, found, test.want, test.found)
+		}
+	}
+}
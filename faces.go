@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"image"
+	"log"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+)
+
+// Finds faces when photos are indexed, so cropping never cuts through
+// anyone. It uses pigo, which runs on the CPU in pure Go, with its
+// facefinder cascade from https://github.com/esimov/pigo/tree/master/cascade
+// Without the cascade file no faces are found and crops just go by detail,
+// and photos are looked at again once there is one, or it's replaced.
+
+type FaceBox struct {
+	// In the photo's pixels, after orientation and its notes
+	X      int32 `json:"x"`
+	Y      int32 `json:"y"`
+	Width  int32 `json:"width"`
+	Height int32 `json:"height"`
+}
+
+var (
+	face_finder      *pigo.Pigo
+	face_finder_hash string // of the cascade it was made from
+	face_finder_once sync.Once
+)
+
+// Photos are searched at no more than this many pixels on their longer
+// side, which finds faces down to a few percent of the photo's width
+const face_search_size = 640
+
+// How sure pigo has to be, its own examples use 5
+const face_quality_threshold = 5.0
+
+func load_face_finder() *pigo.Pigo {
+	// Once, nil if there's no cascade to use
+	face_finder_once.Do(func() {
+		cascade, err := os.ReadFile(config.Faces.CascadeFile)
+		if err != nil {
+			log.Printf("No face cascade, crops won't look for faces: %v\n", err)
+			return
+		}
+		face_finder, err = pigo.NewPigo().Unpack(cascade)
+		if err != nil {
+			log.Printf("Couldn't read the face cascade %v: %v\n", config.Faces.CascadeFile, err)
+			face_finder = nil
+			return
+		}
+		hash := sha1.Sum(cascade)
+		face_finder_hash = hex.EncodeToString(hash[:])
+	})
+	return face_finder
+}
+
+func face_finder_id() string {
+	// Which cascade faces are looked for with, "" if they aren't, so
+	// the index can tell when photos need looking at again
+	load_face_finder()
+	return face_finder_hash
+}
+
+func detect_faces(img image.Image) []FaceBox {
+	finder := load_face_finder()
+	if finder == nil {
+		return nil
+	}
+
+	small := imaging.Fit(img, face_search_size, face_search_size, imaging.Box)
+	width := small.Bounds().Dx()
+	height := small.Bounds().Dy()
+	params := pigo.CascadeParams{
+		MinSize:     20,
+		MaxSize:     min_int(width, height),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{
+			Pixels: pigo.RgbToGrayscale(small),
+			Rows:   height,
+			Cols:   width,
+			Dim:    width,
+		},
+	}
+	detections := finder.ClusterDetections(finder.RunCascade(params, 0), 0.2)
+
+	scale := float64(img.Bounds().Dx()) / float64(width)
+	faces := make([]FaceBox, 0)
+	for _, detection := range detections {
+		if detection.Q < face_quality_threshold {
+			continue
+		}
+		// pigo gives the centre and the side of a square
+		side := float64(detection.Scale) * scale
+		faces = append(faces, FaceBox{
+			X:      int32(math.Round(float64(detection.Col)*scale - side/2)),
+			Y:      int32(math.Round(float64(detection.Row)*scale - side/2)),
+			Width:  int32(math.Round(side)),
+			Height: int32(math.Round(side)),
+		})
+	}
+	return faces
+}
+
+func faces_of(filename string) []FaceBox {
+	// The faces the index found in filename, if any
+	if photo_index == nil {
+		return nil
+	}
+	record, err := photo_index.lookup(filename)
+	if err != nil {
+		return nil
+	}
+	return record.Faces
+}
+
+func (face FaceBox) rect() image.Rectangle {
+	return image.Rect(int(face.X), int(face.Y), int(face.X+face.Width), int(face.Y+face.Height))
+}
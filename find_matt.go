@@ -1,11 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
-	"image/jpeg"
-	"os"
+	"log"
+	"sort"
 	"strconv"
 )
 
@@ -91,170 +92,117 @@ func Format(n int64) string {
 	}
 }
 
-func get_matt_color(filename string) (MyCol, error) {
-
-	file, err := os.Open(filename)
-	if err != nil {
-		fmt.Println("***** Error opening file:", err)
-		return MyCol{}, err
-	}
-	defer file.Close()
-
-	// Decode the image
-	img, format, err := image.Decode(file)
-	fmt.Println(format)
-	if err != nil {
-		fmt.Println("***** Error decoding image:", err)
-		return MyCol{}, err
-	}
-
+func saturation_histogram(img image.Image) []int {
+	// How many of img's pixels have each saturation, the difference
+	// between their brightest and dimmest channel, in 64 steps
+	buckets := make([]int, 64)
 	bounds := img.Bounds()
-	fmt.Println(bounds)
-
-	peak_saturation := 0
-
-	saturation_buckets := make([]int, 64) // 0 is zero
-
-	// Iterate over every pixel
-
-	var max_brightness_seen uint32 = 0
-
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			// Get the color of the pixel
 			r, g, b, _ := img.At(x, y).RGBA()
-			max_brightness := largest(r, g, b)
-			min_brightness := smallest(r, g, b)
-			saturation := max_brightness - min_brightness
-			approx_sat := saturation >> 10 // reduce from 16 bits to 6 bits
-
-			saturation_buckets[approx_sat] += 1
-			if max_brightness > max_brightness_seen {
-				max_brightness_seen = max_brightness
-			}
-
-			// if x < 3 {
-			// 	fmt.Printf("(%d,%d,%d) ", r, g, b)
-			// }
-			// fmt.Print(r)
-
-			if saturation > uint32(peak_saturation) {
-				peak_saturation = int(saturation)
-			}
+			buckets[(largest(r, g, b)-smallest(r, g, b))>>10]++
 		}
 	}
+	return buckets
+}
 
-	target_proportion := 0.024
+// Used when the photos have nothing saturated enough to derive a matt
+// from, the same as the background of composite.html
+var default_matt = MyCol{0x4242, 0x4242, 0x4e4e}
 
-	target_count := int(target_proportion * float64(bounds.Dx()) * float64(bounds.Dy()))
+// How the matt is chosen from the photos' commonest saturated colour,
+// which is nil if they haven't got one, e.g. black and white photos
+type MattStrategy func(dominant *MyCol) MyCol
 
-	min_bucket_to_count := len(saturation_buckets)
-	cumm_count := 0
-	found := false
-	for i := len(saturation_buckets) - 1; i > -1; i-- {
-		fmt.Printf("\t%d: %d\n", i, saturation_buckets[i])
-		cumm_count += saturation_buckets[i]
-		if !found && cumm_count >= target_count {
-			min_bucket_to_count = i
-			found = true
+// Selectable with ?matt= on /composite_map/, which also takes a #rrggbb
+var matt_strategies = map[string]MattStrategy{
+	"complement": func(dominant *MyCol) MyCol {
+		if dominant == nil {
+			return default_matt
 		}
+		return dominant.Complement()
+	},
+	"analogous": func(dominant *MyCol) MyCol {
+		if dominant == nil {
+			return default_matt
+		}
+		return dominant.Analogous(30)
+	},
+	"muted-dominant": func(dominant *MyCol) MyCol {
+		if dominant == nil {
+			return default_matt
+		}
+		return dominant.Muted()
+	},
+	"neutral-grey": func(dominant *MyCol) MyCol {
+		return NeutralGrey()
+	},
+}
 
+func matt_strategy(name string) (MattStrategy, error) {
+	if strategy, found := matt_strategies[name]; found {
+		return strategy, nil
 	}
-
-	fmt.Printf("\n\n\tPeak saturation: %d\n", peak_saturation)
-	fmt.Printf("\n\n\tMax brightness seen: %d\n", max_brightness_seen)
-	fmt.Printf("\n\n\tTop bucket to include: %d\n", min_bucket_to_count)
-
-	threshold := uint32(min_bucket_to_count << 10)
-
-	// buckets:=[]
-
-	fmt.Printf("\tThreshold: %d\n", threshold)
-
-	newImg := image.NewRGBA(img.Bounds())
-
-	counts_by_color := make([]int, 8) // red=msb=4, green=2, blue=1
-	// total := MyCol{0, 0, 0}
-	total_color_vals := make([]MyCol, 8)
-	for i := 0; i < 8; i++ {
-		total_color_vals[i] = MyCol{0, 0, 0}
-	}
-
-	// Iterate over every pixel
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			// Get the color of the pixel
-			r, g, b, _ := img.At(x, y).RGBA()
-			max_brightness := largest(r, g, b)
-			min_brightness := smallest(r, g, b)
-			saturation := max_brightness - min_brightness
-			if saturation > threshold {
-				// Find the most significant bits from the color
-				new_r := (uint8)(r >> 15) // 0/1 << 7 // mapping 0-65535 -> 0 or 128
-				new_g := (uint8)(g >> 15) // 0/1 << 7
-				new_b := (uint8)(b >> 15) // 0/1 << 7
-				three_bit_color := new_r<<2 + new_g<<1 + new_b
-				if y < 2 {
-					fmt.Print(three_bit_color, " ")
-				}
-
-				counts_by_color[three_bit_color]++
-				total_color_vals[three_bit_color] = total_color_vals[three_bit_color].Add(MyCol{uint64(r), uint64(g), uint64(b)})
-				// newImg.SetRGBA(x, y, color.RGBA{new_r << 7, new_g << 7, new_b << 7, 255})
-
-			} else {
-				// newImg.SetRGBA(x, y, color.RGBA{0, 0, 0, 0})
-			}
-			newImg.SetRGBA(x, y, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255})
+	fixed, err := ParseHexColour(name)
+	if err != nil {
+		names := make([]string, 0, len(matt_strategies))
+		for name := range matt_strategies {
+			names = append(names, name)
 		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("matt must be one of %v or a colour #rrggbb", names)
 	}
+	return func(dominant *MyCol) MyCol { return fixed }, nil
+}
 
-	commonest_sat_color_threebit := -1
-	frequency_of_commonest_sat_color := 0
-
-	fmt.Println("\n\n\tFound commonest+saturated stuff:")
-	for i := 1; i < 7; i++ {
-		if counts_by_color[i] > frequency_of_commonest_sat_color {
-			frequency_of_commonest_sat_color = counts_by_color[i]
-			commonest_sat_color_threebit = i
+func composite_matt(snap_set *SnapshotSet, strategy MattStrategy) MyCol {
+	/*
+		The matt the strategy chooses for the commonest strongly saturated
+		colour across all the placed photos, each counting for as much as
+		the area it's shown at, from the palettes in the photo index. The
+		combined palette is kept with the composite too
+	*/
+	palettes := make([]Palette, 0, len(snap_set.Snaps))
+	weights := make([]float64, 0, len(snap_set.Snaps))
+	for _, snap := range snap_set.Snaps {
+		record, err := photo_index.lookup(snap.Location)
+		if err != nil {
+			continue
 		}
-
-		fmt.Printf("\t\tColor: %d, Count: %d, Total: %s\n", i, counts_by_color[i], total_color_vals[i].Commaed())
+		palettes = append(palettes, record.Palette)
+		weights = append(weights, float64(snap.Width)*float64(snap.Height))
 	}
-	fmt.Printf("\n\tCommonest of the sat colors roughly: %d\n", commonest_sat_color_threebit)
-
-	commonest_sat_color := total_color_vals[commonest_sat_color_threebit].Divide(counts_by_color[commonest_sat_color_threebit])
-
-	fmt.Printf("\n\tCommonest saturated color (48 bit): %d\n", commonest_sat_color)
-
-	complement := commonest_sat_color.Complement()
-	fmt.Printf("\n\tComplement of commonest saturated color (48 bit): %d\n", complement)
+	snap_set.Palette = combine_palettes(palettes, weights)
+	return matt_of_palette(snap_set.Palette, strategy)
+}
 
-	// Draw a block of pixels in the top left with the commonest saturated color
-	for y := 0; y < 80; y++ {
-		for x := 0; x < 80; x++ {
-			newImg.SetRGBA(x, y, commonest_sat_color.GetRGBA())
-		}
+func matt_of_palette(palette Palette, strategy MattStrategy) MyCol {
+	dominant := palette.dominant()
+	if dominant == nil {
+		log.Println("No colour to base the matt on, they're all too grey")
 	}
+	return strategy(dominant)
+}
 
-	// Draw a big block down the right hand side of the complementary color
-	for y := 0; y < bounds.Dy(); y++ {
-		for x := bounds.Dx() - 240; x < bounds.Dx(); x++ {
-			newImg.SetRGBA(x, y, complement.GetRGBA())
-		}
+func check_background(background string) error {
+	if background != "plain" && background != "gradient" {
+		return errors.New("background must be plain or gradient")
 	}
+	return nil
+}
 
-	// Display the image
-	file, err = os.Create("result.jpg")
-	if err != nil {
-		fmt.Println("Error creating file:", err)
-		return MyCol{}, err
-	}
-	defer file.Close()
-	err = jpeg.Encode(file, newImg, nil)
-	if err != nil {
-		fmt.Println("Error writing out image:", err)
-		return MyCol{}, err
+func matt_gradient(palette Palette, matt MyCol, strategy MattStrategy) []MyCol {
+	/*
+		From the matt to what the strategy makes of the palette's next
+		commonest saturated colour, or if there isn't one or it comes out
+		the same, e.g. a fixed colour, to a darker shade of the matt
+	*/
+	if saturated := palette.saturated(); len(saturated) > 1 {
+		second := strategy(&saturated[1])
+		if second.lab().distance(matt.lab()) >= palette_merge_distance {
+			return []MyCol{matt, second}
+		}
 	}
-	return complement, nil
+	l, _, _ := matt.ToLab()
+	return []MyCol{matt, matt.WithLightness(l * 0.5)}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Offline lookup of place names for photos' GPS positions, so nothing
+// about where the family has been is sent off to a web service. It reads
+// a GeoNames dump, e.g. cities1000.txt from
+// https://download.geonames.org/export/dump/ which is tab separated
+// with the name in the 2nd column, latitude and longitude in the 5th
+// and 6th, and the country code in the 9th.
+
+type Place struct {
+	Name     string
+	Country  string
+	Position GeoPoint
+}
+
+type Gazetteer struct {
+	// Places by whole degree of latitude and longitude, so only the
+	// squares around a position have to be searched
+	squares map[[2]int][]Place
+	count   int
+}
+
+func square_of(point GeoPoint) [2]int {
+	return [2]int{int(math.Floor(point.Latitude)), int(math.Floor(point.Longitude))}
+}
+
+func load_gazetteer(filename string) *Gazetteer {
+	// An empty gazetteer, which names nowhere, if the file can't be read
+	gazetteer := &Gazetteer{squares: make(map[[2]int][]Place)}
+	if filename == "" {
+		return gazetteer
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Printf("No gazetteer, captions won't name places: %v\n", err)
+		return gazetteer
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // alternate names can be long
+	for scanner.Scan() {
+		columns := strings.Split(scanner.Text(), "\t")
+		if len(columns) < 9 {
+			continue
+		}
+		latitude, err := strconv.ParseFloat(columns[4], 64)
+		if err != nil {
+			continue
+		}
+		longitude, err := strconv.ParseFloat(columns[5], 64)
+		if err != nil {
+			continue
+		}
+		place := Place{Name: columns[1], Country: columns[8], Position: GeoPoint{latitude, longitude}}
+		square := square_of(place.Position)
+		gazetteer.squares[square] = append(gazetteer.squares[square], place)
+		gazetteer.count++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Couldn't read all of the gazetteer %v: %v\n", filename, err)
+	}
+	log.Printf("Loaded %d places from %v\n", gazetteer.count, filename)
+	return gazetteer
+}
+
+func (gazetteer *Gazetteer) nearest(point GeoPoint, within_km float64) (Place, bool) {
+	// The closest place no more than within_km away, which should be
+	// less than a degree's worth
+	best := Place{}
+	best_distance := within_km
+	found := false
+	square := square_of(point)
+	for latitude := square[0] - 1; latitude <= square[0]+1; latitude++ {
+		for longitude := square[1] - 1; longitude <= square[1]+1; longitude++ {
+			for _, place := range gazetteer.squares[[2]int{latitude, longitude}] {
+				distance := distance_between(point, place.Position)
+				if distance <= best_distance {
+					best = place
+					best_distance = distance
+					found = true
+				}
+			}
+		}
+	}
+	return best, found
+}
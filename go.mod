@@ -4,8 +4,11 @@ go 1.19
 
 require (
 	github.com/disintegration/imaging v1.6.2 // indirect
+	github.com/esimov/pigo v1.4.6 // indirect
+	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
 	golang.org/x/image v0.15.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	rsc.io/sampler v1.3.0 // indirect
 )
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math"
+)
+
+// Flickr/Google Photos style, images are laid out in rows, every image
+// in a row sharing the same height, with each row exactly filling the
+// width of the canvas. Row breaks are chosen so that row heights stay
+// close to a target, and every possible target (from one row up to one
+// row per image) is tried, keeping whichever shows the most photo once
+// the whole thing has been scaled to fit the height.
+
+type JustifiedLayout struct{}
+
+func (layout JustifiedLayout) place(snapshots []Snapshot, canvas Canvas) SnapshotSet {
+	aspects := make([]float64, len(snapshots))
+	for i, snap := range snapshots {
+		aspects[i] = float64(snap.Width) / float64(snap.Height)
+	}
+
+	var best_rows [][]int
+	best_area := -1.0
+	for row_count := 1; row_count <= len(snapshots); row_count++ {
+		target_height := float64(canvas.Height) / float64(row_count)
+		rows := break_into_rows(aspects, canvas, target_height)
+		row_width := justified_row_width(rows, aspects, canvas)
+		area := justified_area(rows, aspects, canvas, row_width)
+		if area > best_area {
+			best_area = area
+			best_rows = rows
+		}
+	}
+
+	return canvas.visible(justified_snapshot_set(snapshots, best_rows, aspects, canvas))
+}
+
+func justified_row_height(row []int, aspects []float64, canvas Canvas, row_width float64) float64 {
+	// The height the photos in a row must have for the row, including
+	// their borders and the gutters either side of them, to be row_width
+	aspect_sum := 0.0
+	for _, i := range row {
+		aspect_sum += aspects[i]
+	}
+	return (row_width - justified_row_spacing(len(row), canvas)) / aspect_sum
+}
+
+func justified_row_spacing(count int, canvas Canvas) float64 {
+	// How much of a row of count photos is taken by borders and gutters
+	return float64(count*2*canvas.Border + (count+1)*canvas.Gutter)
+}
+
+func justified_row_width(rows [][]int, aspects []float64, canvas Canvas) float64 {
+	/*
+		The width every row can be while still all fitting in the height,
+		never more than the canvas. A row's height is linear in its
+		width, so the total height of all the rows is too, giving
+			total = row_width * sum(1/aspect_sum) - sum(spacing/aspect_sum)
+				+ rows*2*border + (rows+1)*gutter
+		which is solved for total = height
+	*/
+	inverse_sum := 0.0
+	spacing_sum := 0.0
+	for _, row := range rows {
+		aspect_sum := 0.0
+		for _, i := range row {
+			aspect_sum += aspects[i]
+		}
+		inverse_sum += 1 / aspect_sum
+		spacing_sum += justified_row_spacing(len(row), canvas) / aspect_sum
+	}
+	fixed := float64(len(rows)*2*canvas.Border + (len(rows)+1)*canvas.Gutter)
+	fitting := (float64(canvas.Height) - fixed + spacing_sum) / inverse_sum
+	return math.Min(float64(canvas.Width), fitting)
+}
+
+func justified_area(rows [][]int, aspects []float64, canvas Canvas, row_width float64) float64 {
+	// Area of photo, including borders, shown by the rows, or 0 if
+	// the gutters and borders leave no room for any of it
+	area := 0.0
+	border := float64(canvas.Border)
+	for _, row := range rows {
+		row_height := justified_row_height(row, aspects, canvas, row_width)
+		if row_height <= 0 {
+			return 0
+		}
+		for _, i := range row {
+			area += (row_height*aspects[i] + 2*border) * (row_height + 2*border)
+		}
+	}
+	return area
+}
+
+func break_into_rows(aspects []float64, canvas Canvas, target_height float64) [][]int {
+	/*
+		Linear partition by dynamic programming, keeping the images in
+		order, choosing the row breaks which minimise the sum of the
+		squared differences between each row's height and target_height
+
+		cost[i] is the cheapest way to lay out the first i images
+		and start[i] where the last row of that layout begins
+	*/
+	count := len(aspects)
+	cost := make([]float64, count+1)
+	start := make([]int, count+1)
+	for i := 1; i <= count; i++ {
+		cost[i] = math.Inf(1)
+		aspect_sum := 0.0
+		for j := i; j > 0; j-- {
+			aspect_sum += aspects[j-1]
+			row_height := (float64(canvas.Width)-justified_row_spacing(i-j+1, canvas))/aspect_sum + float64(2*canvas.Border)
+			miss := row_height - target_height
+			if cost[j-1]+miss*miss < cost[i] {
+				cost[i] = cost[j-1] + miss*miss
+				start[i] = j - 1
+			}
+			// Rows only get shorter from here, so no point carrying on
+			if row_height < target_height/2 {
+				break
+			}
+		}
+	}
+
+	// Walk back through the breaks to recover the rows
+	rows := make([][]int, 0)
+	for end := count; end > 0; end = start[end] {
+		row := make([]int, 0, end-start[end])
+		for i := start[end]; i < end; i++ {
+			row = append(row, i)
+		}
+		rows = append([][]int{row}, rows...)
+	}
+	return rows
+}
+
+func justified_snapshot_set(snapshots []Snapshot, rows [][]int, aspects []float64, canvas Canvas) SnapshotSet {
+	row_width := justified_row_width(rows, aspects, canvas)
+	gutter := float64(canvas.Gutter)
+	border := float64(canvas.Border)
+
+	total_height := gutter
+	for _, row := range rows {
+		total_height += justified_row_height(row, aspects, canvas, row_width) + 2*border + gutter
+	}
+
+	// Having narrowed to fit the height, centre what's left in both directions
+	x_leftover := (float64(canvas.Width) - row_width) / 2
+	y := (float64(canvas.Height)-total_height)/2 + gutter
+
+	snap_set := SnapshotSet{}
+	for _, row := range rows {
+		row_height := justified_row_height(row, aspects, canvas, row_width) + 2*border
+		x := x_leftover + gutter
+		for n, i := range row {
+			snap := snapshots[i]
+			next_x := x + (row_height-2*border)*aspects[i] + 2*border
+			if n == len(row)-1 {
+				// Take up any rounding so the row ends flush
+				next_x = x_leftover + row_width - gutter
+			}
+			snap.X = int32(math.Round(x))
+			snap.Y = int32(math.Round(y))
+			snap.Width = int32(math.Round(next_x)) - snap.X
+			snap.Height = int32(math.Round(y+row_height)) - snap.Y
+			canvas.framed(&snap)
+			snap_set.append(snap)
+			x = next_x + gutter
+		}
+		y += row_height + gutter
+	}
+	return snap_set
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"time"
+)
+
+// A Layout arranges a set of snapshots onto a canvas, returning the
+// placed set with every snapshot positioned and sized in canvas pixels
+
+type Layout interface {
+	place(snapshots []Snapshot, canvas Canvas) SnapshotSet
+}
+
+// The window a layout is placing snapshots on. Gutter is the matt left
+// between neighbouring photos and around the edge of the canvas, and
+// Border the frame drawn just inside each photo's box, both in canvas
+// pixels so they come out the same whatever scaling the layout does.
+// CropTolerance is how far from its own shape a photo's box can be
+// stretched to fill the space around it, as a fraction of its aspect
+// ratio, the photo being cropped to fit (see smart_crop).
+
+type Canvas struct {
+	Width         int
+	Height        int
+	Gutter        int
+	Border        int
+	CropTolerance float64
+}
+
+// The layouts selectable with ?layout= on /composite_map/
+var layouts = map[string]Layout{
+	"gravity":   GravityLayout{},
+	"grid":      GridLayout{},
+	"masonry":   MasonryLayout{},
+	"justified": JustifiedLayout{},
+	"optimised": OptimisedLayout{budget: 250 * time.Millisecond},
+}
+
+const default_layout = "optimised"
+
+func layout_names() []string {
+	names := make([]string, 0, len(layouts))
+	for name := range layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (canvas Canvas) framed(snap *Snapshot) {
+	// Marks a placed snapshot with the canvas' border
+	snap.Border = int32(canvas.Border)
+}
+
+func (canvas Canvas) check_room() error {
+	// Whether a gutter all round and a border either side of a photo
+	// leave anything of the canvas to show it in
+	spacing := 2*canvas.Gutter + 2*canvas.Border
+	if canvas.Width <= spacing || canvas.Height <= spacing {
+		return fmt.Errorf("a gutter of %d and border of %d leave no room for photos on a %dx%d canvas", canvas.Gutter, canvas.Border, canvas.Width, canvas.Height)
+	}
+	return nil
+}
+
+func (canvas Canvas) visible(snap_set SnapshotSet) SnapshotSet {
+	// The set without any boxes too small to show some photo inside
+	// their border, which no layout should ever hand back
+	kept := snap_set
+	kept.Snaps = make([]*Snapshot, 0, len(snap_set.Snaps))
+	for _, snap := range snap_set.Snaps {
+		if canvas.has_room(float64(snap.Width), float64(snap.Height)) {
+			kept.Snaps = append(kept.Snaps, snap)
+		}
+	}
+	return kept
+}
+
+func (canvas Canvas) has_room(box_width float64, box_height float64) bool {
+	// Whether a box this size would show any photo inside its border
+	return box_width > float64(2*canvas.Border) && box_height > float64(2*canvas.Border)
+}
+
+// The original packer, each image is added in turn as close as it
+// will go to the centre of gravity of those already placed
+
+type GravityLayout struct{}
+
+func (layout GravityLayout) place(snapshots []Snapshot, canvas Canvas) SnapshotSet {
+	snap_set, gain := gravity_pack(snapshots, canvas, 0)
+	spacing := canvas.Gutter + 2*canvas.Border
+	if spacing == 0 || gain <= 0 {
+		return canvas.visible(snap_set)
+	}
+
+	// Packing happens before scaling, so to come out with the right
+	// spacing pack again with each photo padded by what the gutter
+	// and border will take up once scaled by about the same gain...
+	pad := int32(math.Ceil(float64(spacing) / gain))
+	snap_set, _ = gravity_pack(snapshots, canvas, pad)
+
+	// ...and then take the gutter back off every padded photo
+	half_gutter := int32(canvas.Gutter / 2)
+	for _, snap := range snap_set.Snaps {
+		snap.X += half_gutter
+		snap.Y += half_gutter
+		snap.Width -= int32(canvas.Gutter)
+		snap.Height -= int32(canvas.Gutter)
+		canvas.framed(snap)
+	}
+	return canvas.visible(snap_set)
+}
+
+func gravity_pack(snapshots []Snapshot, canvas Canvas, pad int32) (SnapshotSet, float64) {
+	/*
+		Packs the snapshots, each grown by pad, then scales them to fit
+		inside the canvas less a gutter's width, so that once the photos
+		are shrunk by half a gutter all round there is a whole gutter at
+		the edges. Returns the set and the gain it was scaled by.
+	*/
+
+	// Create the snapshotset with all of the images placed
+	// On to a theoretical huge canvas 5000x5000
+	// packing towards the shape of the window
+
+	snap_set := SnapshotSet{target_aspect: float64(canvas.Width) / float64(canvas.Height)}
+
+	//Place the first in the middle of that field
+	first_img := snapshots[0]
+	first_img.Width += pad
+	first_img.Height += pad
+	first_img.X = 5000 - first_img.Width/2
+	first_img.Y = 5000 - first_img.Height/2
+	snap_set.append(first_img)
+
+	// Now add some more to minimise gravity
+
+	for i := 1; i < len(snapshots); i++ {
+		another_img := snapshots[i]
+		another_img.Width += pad
+		another_img.Height += pad
+		snap_set.fit_another(&another_img)
+	}
+
+	// rescale to the window
+	// trims the space around the large compositing canvas
+	gain := snap_set.rescale_to_window(canvas.Width-canvas.Gutter, canvas.Height-canvas.Gutter)
+	for _, snap := range snap_set.Snaps {
+		snap.X += int32(canvas.Gutter / 2)
+		snap.Y += int32(canvas.Gutter / 2)
+	}
+	return snap_set, gain
+}
+
+// Every image gets an equal cell in a rows x columns grid, and is
+// shrunk to fit inside its cell, keeping its aspect ratio
+
+type GridLayout struct{}
+
+func (layout GridLayout) place(snapshots []Snapshot, canvas Canvas) SnapshotSet {
+	best_set := SnapshotSet{}
+	best_area := -1.0
+	gutter := float64(canvas.Gutter)
+	border := float64(canvas.Border)
+
+	// Try every column count and keep whichever shows the most photo
+	for cols := 1; cols <= len(snapshots); cols++ {
+		rows := (len(snapshots) + cols - 1) / cols
+		cell_width := (float64(canvas.Width) - gutter*float64(cols+1)) / float64(cols)
+		cell_height := (float64(canvas.Height) - gutter*float64(rows+1)) / float64(rows)
+		if !canvas.has_room(cell_width, cell_height) {
+			continue
+		}
+
+		snap_set := SnapshotSet{}
+		area := 0.0
+		for i, snap := range snapshots {
+			gain := math.Min((cell_width-2*border)/float64(snap.Width), (cell_height-2*border)/float64(snap.Height))
+			new_width := math.Floor(float64(snap.Width)*gain + 2*border)
+			new_height := math.Floor(float64(snap.Height)*gain + 2*border)
+
+			// Centre it in its cell
+			col := i % cols
+			row := i / cols
+			snap.X = int32(gutter + float64(col)*(cell_width+gutter) + (cell_width-new_width)/2)
+			snap.Y = int32(gutter + float64(row)*(cell_height+gutter) + (cell_height-new_height)/2)
+			snap.Width = int32(new_width)
+			snap.Height = int32(new_height)
+			canvas.framed(&snap)
+
+			snap_set.append(snap)
+			area += new_width * new_height
+		}
+		if area > best_area {
+			best_area = area
+			best_set = snap_set
+		}
+	}
+	return canvas.visible(best_set)
+}
+
+// Pinterest style, images are stacked into equal width columns, each
+// going on to whichever column is currently shortest
+
+type MasonryLayout struct{}
+
+func (layout MasonryLayout) place(snapshots []Snapshot, canvas Canvas) SnapshotSet {
+	best_set := SnapshotSet{}
+	best_area := -1.0
+	gutter := float64(canvas.Gutter)
+	border := float64(canvas.Border)
+
+	for cols := 1; cols <= len(snapshots); cols++ {
+		col_width := (float64(canvas.Width) - gutter*float64(cols+1)) / float64(cols)
+		if !canvas.has_room(col_width, col_width) {
+			break
+		}
+
+		// Share them out between the columns at full column width first
+		col_heights := make([]float64, cols)
+		col_inverse_aspects := make([]float64, cols)
+		col_counts := make([]int, cols)
+		col_of := make([]int, len(snapshots))
+		for i, snap := range snapshots {
+			shortest := 0
+			for col := range col_heights {
+				if col_heights[col] < col_heights[shortest] {
+					shortest = col
+				}
+			}
+			inverse_aspect := float64(snap.Height) / float64(snap.Width)
+			col_heights[shortest] += (col_width-2*border)*inverse_aspect + 2*border + gutter
+			col_inverse_aspects[shortest] += inverse_aspect
+			col_counts[shortest]++
+			col_of[i] = shortest
+		}
+
+		// Then narrow the columns if the tallest overflows, the gutters
+		// and borders staying the same size, as each column's height is
+		//   (col_width - 2*border) * sum(1/aspect) + count*2*border + (count+1)*gutter
+		for col := range col_heights {
+			if col_counts[col] == 0 {
+				continue
+			}
+			fixed := float64(col_counts[col])*2*border + float64(col_counts[col]+1)*gutter
+			widest_fitting := (float64(canvas.Height)-fixed)/col_inverse_aspects[col] + 2*border
+			col_width = math.Min(col_width, widest_fitting)
+		}
+		if !canvas.has_room(col_width, col_width) {
+			continue
+		}
+
+		tallest := 0.0
+		for col := range col_heights {
+			col_heights[col] = (col_width-2*border)*col_inverse_aspects[col] + float64(col_counts[col])*2*border + float64(col_counts[col]+1)*gutter
+			tallest = math.Max(tallest, col_heights[col])
+		}
+		x_leftover := (float64(canvas.Width) - col_width*float64(cols) - gutter*float64(cols+1)) / 2
+		y_leftover := (float64(canvas.Height) - tallest) / 2
+
+		col_ys := make([]float64, cols)
+		snap_set := SnapshotSet{}
+		area := 0.0
+		for i, snap := range snapshots {
+			col := col_of[i]
+			snap_height := (col_width-2*border)*float64(snap.Height)/float64(snap.Width) + 2*border
+			x := x_leftover + gutter + float64(col)*(col_width+gutter)
+			y := y_leftover + gutter + col_ys[col]
+			snap.X = int32(math.Round(x))
+			snap.Y = int32(math.Round(y))
+			snap.Width = int32(math.Round(x+col_width)) - snap.X
+			snap.Height = int32(math.Round(y+snap_height)) - snap.Y
+			canvas.framed(&snap)
+			col_ys[col] += snap_height + gutter
+
+			snap_set.append(snap)
+			area += float64(snap.Width) * float64(snap.Height)
+		}
+		if area > best_area {
+			best_area = area
+			best_set = snap_set
+		}
+	}
+	return canvas.visible(best_set)
+}
+
+func fill_gaps(snap_set *SnapshotSet, canvas Canvas) {
+	/*
+		Grows each placed photo's box into any matt beside it, up to a
+		gutter from its neighbours and the edge of the canvas, as far as
+		canvas.CropTolerance allows its shape to change. Whatever layout
+		placed them, this fills the holes keeping photos to their own
+		aspect ratios leaves. Photos with faces in go first, so they get
+		the pick of the space.
+	*/
+	gutter := canvas.Gutter
+	border := canvas.Border
+	clashes := func(a image.Rectangle, b image.Rectangle) bool {
+		return a.Min.X < b.Max.X+gutter && b.Min.X < a.Max.X+gutter && a.Min.Y < b.Max.Y+gutter && b.Min.Y < a.Max.Y+gutter
+	}
+	order := make([]int, len(snap_set.Snaps))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return len(faces_of(snap_set.Snaps[order[a]].Location)) > 0 && len(faces_of(snap_set.Snaps[order[b]].Location)) == 0
+	})
+	for _, i := range order {
+		snap := snap_set.Snaps[i]
+		box := snap.getRect()
+		inner_width := float64(box.Dx()) - 2*float64(border)
+		inner_height := float64(box.Dy()) - 2*float64(border)
+		if inner_width <= 0 || inner_height <= 0 {
+			continue
+		}
+		aspect := inner_width / inner_height
+
+		// How far each side could go before meeting something
+		left, top := box.Min.X-gutter, box.Min.Y-gutter
+		right, bottom := canvas.Width-gutter-box.Max.X, canvas.Height-gutter-box.Max.Y
+		others := make([]image.Rectangle, 0, len(snap_set.Snaps)-1)
+		for j, other := range snap_set.Snaps {
+			if j == i {
+				continue
+			}
+			o := other.getRect()
+			if !clashes(box, o) {
+				others = append(others, o)
+			}
+			if o.Min.Y < box.Max.Y && o.Max.Y > box.Min.Y {
+				if o.Min.X >= box.Max.X {
+					right = min_int(right, o.Min.X-gutter-box.Max.X)
+				} else if o.Max.X <= box.Min.X {
+					left = min_int(left, box.Min.X-gutter-o.Max.X)
+				}
+			}
+			if o.Min.X < box.Max.X && o.Max.X > box.Min.X {
+				if o.Min.Y >= box.Max.Y {
+					bottom = min_int(bottom, o.Min.Y-gutter-box.Max.Y)
+				} else if o.Max.Y <= box.Min.Y {
+					top = min_int(top, box.Min.Y-gutter-o.Max.Y)
+				}
+			}
+		}
+		left, right, top, bottom = max_int(left, 0), max_int(right, 0), max_int(top, 0), max_int(bottom, 0)
+
+		// The biggest box within reach that's still near enough in shape
+		width := inner_width + float64(left+right)
+		height := inner_height + float64(top+bottom)
+		widest := aspect * (1 + canvas.CropTolerance)
+		narrowest := aspect / (1 + canvas.CropTolerance)
+		if width/height > widest {
+			width = height * widest
+		}
+		if width/height < narrowest {
+			height = width / narrowest
+		}
+		grow_x := int(width - inner_width)
+		grow_y := int(height - inner_height)
+
+		// Growing both ways can clip a neighbour diagonally, in which
+		// case try growing just the one way that gains the most
+		candidates := []image.Rectangle{grown(box, grow_x, left, right, grow_y, top, bottom)}
+		across := grown(box, int(math.Min(inner_height*widest-inner_width, float64(left+right))), left, right, 0, 0, 0)
+		down := grown(box, 0, 0, 0, int(math.Min(inner_width/narrowest-inner_height, float64(top+bottom))), top, bottom)
+		if across.Dx()*across.Dy() > down.Dx()*down.Dy() {
+			candidates = append(candidates, across, down)
+		} else {
+			candidates = append(candidates, down, across)
+		}
+		for _, candidate := range candidates {
+			fits := true
+			for _, other := range others {
+				if clashes(candidate, other) {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				snap.X, snap.Y = int32(candidate.Min.X), int32(candidate.Min.Y)
+				snap.Width, snap.Height = int32(candidate.Dx()), int32(candidate.Dy())
+				break
+			}
+		}
+	}
+}
+
+func grown(box image.Rectangle, grow_x int, left int, right int, grow_y int, top int, bottom int) image.Rectangle {
+	// box grown by grow_x across and grow_y down, shared between the sides
+	// in proportion to the room each has
+	if grow_x > 0 {
+		to_left := int(math.Round(float64(grow_x) * float64(left) / float64(left+right)))
+		box.Min.X -= to_left
+		box.Max.X += grow_x - to_left
+	}
+	if grow_y > 0 {
+		to_top := int(math.Round(float64(grow_y) * float64(top) / float64(top+bottom)))
+		box.Min.Y -= to_top
+		box.Max.Y += grow_y - to_top
+	}
+	return box
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func layout_snapshots() []Snapshot {
+	// A mix of landscape, portrait and panoramic photos
+	sizes := [][2]int32{{600, 400}, {400, 600}, {800, 200}, {500, 500}, {600, 400}, {300, 450}}
+	snapshots := make([]Snapshot, len(sizes))
+	for i, size := range sizes {
+		snapshots[i] = Snapshot{Width: size[0], Height: size[1], Location: string(rune('a'+i)) + ".jpg"}
+	}
+	return snapshots
+}
+
+func TestCanvasCheckRoom(t *testing.T) {
+	tests := []struct {
+		canvas Canvas
+		fits   bool
+	}{
+		{Canvas{Width: 800, Height: 600}, true},
+		{Canvas{Width: 1000, Height: 700, Gutter: 200, Border: 100}, true},
+		{Canvas{Width: 10, Height: 10, Gutter: 200}, false},
+		{Canvas{Width: 10, Height: 10, Border: 100}, false},
+		{Canvas{Width: 800, Height: 200, Gutter: 50, Border: 50}, false},
+		{Canvas{Width: 800, Height: 201, Gutter: 50, Border: 50}, true},
+	}
+	for _, test := range tests {
+		if err := test.canvas.check_room(); (err == nil) != test.fits {
+			t.Errorf("%+v: error %v, want room %v", test.canvas, err, test.fits)
+		}
+	}
+}
+
+func TestLayoutsNeverPlaceEmptyBoxes(t *testing.T) {
+	tests := []struct {
+		canvas    Canvas
+		place_all bool
+	}{
+		{Canvas{Width: 800, Height: 600, Gutter: 10, Border: 5}, true},
+		{Canvas{Width: 1000, Height: 700, Gutter: 100, Border: 50}, false},
+		// Room for a photo on its own but not for six of them
+		{Canvas{Width: 1000, Height: 700, Gutter: 200, Border: 100}, false},
+		{Canvas{Width: 300, Height: 120, Gutter: 20, Border: 30}, false},
+	}
+	for name, layout := range layouts {
+		if optimised, ok := layout.(OptimisedLayout); ok {
+			optimised.budget = 0
+			layout = optimised
+		}
+		for _, test := range tests {
+			canvas := test.canvas
+			snap_set := layout.place(layout_snapshots(), canvas)
+			if test.place_all && len(snap_set.Snaps) != len(layout_snapshots()) {
+				t.Errorf("%v on %+v: placed %d photos, want all of them", name, canvas, len(snap_set.Snaps))
+			}
+			for _, snap := range snap_set.Snaps {
+				if !canvas.has_room(float64(snap.Width), float64(snap.Height)) {
+					t.Errorf("%v on %+v: placed %v at %vx%v", name, canvas, snap.Location, snap.Width, snap.Height)
+				}
+			}
+		}
+	}
+}
+
+func TestOptimisedLayoutStopsEarly(t *testing.T) {
+	// However long it's allowed, it shouldn't need it for this few photos
+	canvas := Canvas{Width: 1200, Height: 800, Gutter: 10}
+	layout := OptimisedLayout{budget: time.Minute}
+	for _, snapshots := range [][]Snapshot{layout_snapshots()[:4], layout_snapshots(), append(layout_snapshots(), layout_snapshots()...)} {
+		started := time.Now()
+		snap_set := layout.place(snapshots, canvas)
+		if elapsed := time.Since(started); elapsed > 20*time.Second {
+			t.Errorf("%d photos took %v", len(snapshots), elapsed)
+		}
+		if len(snap_set.Snaps) != len(snapshots) {
+			t.Errorf("%d photos: placed %d", len(snapshots), len(snap_set.Snaps))
+		}
+	}
+}
+
+func TestOptimisedLayoutTriesEveryOrdering(t *testing.T) {
+	// Nothing the gravity packer makes of any ordering covers more
+	canvas := Canvas{Width: 1200, Height: 800, Gutter: 10}
+	snapshots := layout_snapshots()[:4]
+	best_set := OptimisedLayout{budget: time.Minute}.place(snapshots, canvas)
+	best_score := layout_coverage(&best_set, canvas.Width, canvas.Height)
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {1, 3, 0, 2}, {2, 0, 3, 1}} {
+		reordered := make([]Snapshot, len(order))
+		for i, j := range order {
+			reordered[i] = snapshots[j]
+		}
+		snap_set := GravityLayout{}.place(reordered, canvas)
+		if score := layout_coverage(&snap_set, canvas.Width, canvas.Height); score > best_score {
+			t.Errorf("ordering %v covers %.3f, more than the best found %.3f", order, score, best_score)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// /debug/matt/{photo} shows how a photo's matt was chosen: the photo on
+// its matt, its palette with each colour as wide as its share, and how
+// saturated its pixels are. ?matt= picks the strategy as for
+// /composite_map/.
+
+const (
+	debug_width          = 720
+	debug_photo_height   = 480
+	debug_palette_height = 60
+	debug_chart_height   = 120
+	debug_margin         = 40
+)
+
+var (
+	debug_background = color.RGBA{32, 32, 32, 255}
+	debug_bar_colour = color.RGBA{200, 200, 200, 255}
+)
+
+func mattDebugHandler(response http.ResponseWriter, request *http.Request) {
+	filename, _ := strings.CutPrefix(request.URL.Path, "/debug/matt/")
+
+	// Only what's in the index, so nothing outside photos/ can be asked for
+	if _, err := photo_index.lookup(filename); err != nil {
+		http.Error(response, "Couldn't find the requested image", 404)
+		return
+	}
+	matt_name := request.URL.Query().Get("matt")
+	if matt_name == "" {
+		matt_name = config.Matt.Strategy
+	}
+	strategy, err := matt_strategy(matt_name)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return
+	}
+
+	photo, err := fetch_image_from_file("photos/", filename)
+	if err != nil {
+		log.Printf("Couldn't read %v for the matt debug: %v\n", filename, err)
+		http.Error(response, "Couldn't read the image", 500)
+		return
+	}
+	img := render_matt_debug(photo, matt_name, strategy)
+
+	buffer := new(bytes.Buffer)
+	if err := png.Encode(buffer, img); err != nil {
+		log.Printf("Unable to encode the matt debug: %v\n", err)
+		http.Error(response, "Couldn't encode the image", 500)
+		return
+	}
+	response.Header().Set("Content-Type", "image/png")
+	response.Header().Set("Content-Length", strconv.Itoa(buffer.Len()))
+	if _, err := response.Write(buffer.Bytes()); err != nil {
+		log.Println("unable to write image.")
+	}
+}
+
+func render_matt_debug(photo image.Image, matt_name string, strategy MattStrategy) *image.RGBA {
+	palette := extract_palette(photo)
+	dominant := palette.dominant()
+	matt := strategy(dominant)
+	line_height := caption_face.Metrics().Height.Ceil()
+
+	photo_area := image.Rect(0, 0, debug_width, debug_photo_height)
+	palette_area := image.Rect(0, photo_area.Max.Y+line_height, debug_width, photo_area.Max.Y+line_height+debug_palette_height)
+	chart_area := image.Rect(0, palette_area.Max.Y+line_height+debug_margin/2, debug_width, palette_area.Max.Y+line_height+debug_margin/2+debug_chart_height)
+	img := image.NewRGBA(image.Rect(0, 0, debug_width, chart_area.Max.Y+line_height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{debug_background}, image.Point{}, draw.Src)
+
+	// The photo on its matt
+	draw.Draw(img, photo_area, &image.Uniform{matt.GetRGBA()}, image.Point{}, draw.Src)
+	small := imaging.Fit(photo, debug_width-2*debug_margin, debug_photo_height-2*debug_margin, imaging.Box)
+	at := image.Pt((debug_width-small.Bounds().Dx())/2, (debug_photo_height-small.Bounds().Dy())/2)
+	draw.Draw(img, small.Bounds().Add(at), small, image.Point{}, draw.Src)
+	debug_label(img, image.Pt(4, photo_area.Max.Y), fmt.Sprintf("matt %v %v", matt_name, matt.Hex()))
+
+	// The palette, the colour the matt is based on marked
+	x := 0
+	for i, colour := range palette {
+		width := int(colour.Weight * debug_width)
+		if i == len(palette)-1 {
+			width = debug_width - x
+		}
+		block := image.Rect(x, palette_area.Min.Y, x+width, palette_area.Max.Y)
+		draw.Draw(img, block, &image.Uniform{colour.Colour.GetRGBA()}, image.Point{}, draw.Src)
+		label := colour.Colour.Hex()
+		if dominant != nil && colour.Colour == *dominant {
+			label += " *"
+		}
+		if len(label)*caption_face.Advance < width {
+			debug_label(img, image.Pt(x+2, palette_area.Max.Y), label)
+		}
+		x += width
+	}
+
+	// How saturated the pixels are, least on the left
+	histogram := saturation_histogram(analysis_thumbnail(photo, palette_sample_size*4))
+	highest := 1
+	for _, count := range histogram {
+		highest = max_int(highest, count)
+	}
+	bar_width := debug_width / len(histogram)
+	for i, count := range histogram {
+		height := count * debug_chart_height / highest
+		bar := image.Rect(i*bar_width, chart_area.Max.Y-height, (i+1)*bar_width-1, chart_area.Max.Y)
+		draw.Draw(img, bar, &image.Uniform{debug_bar_colour}, image.Point{}, draw.Src)
+	}
+	debug_label(img, image.Pt(4, chart_area.Max.Y), "saturation, grey to fully saturated")
+	return img
+}
+
+func debug_label(img *image.RGBA, at image.Point, text string) {
+	// One line of text with its top left at at
+	drawer := font.Drawer{Dst: img, Src: &image.Uniform{caption_colour}, Face: caption_face}
+	drawer.Dot = fixed.P(at.X, at.Y+caption_face.Ascent)
+	drawer.DrawString(text)
+}
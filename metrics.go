@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+)
+
+// Objective measures of how well a placed SnapshotSet uses the canvas,
+// returned with the composite map so layout strategies can be compared
+
+type LayoutMetrics struct {
+	Coverage       float64 `json:"coverage"`         // fraction of the canvas showing photos
+	WastedMattArea int64   `json:"wasted_matt_area"` // canvas pixels showing only matt
+	HoleArea       int64   `json:"hole_area"`        // matt pixels inside the photos' bounding box
+	SmallestScale  float64 `json:"smallest_scale"`   // displayed/original width of the most shrunk photo
+	AspectMismatch float64 `json:"aspect_mismatch"`  // |ln(bounding box aspect / canvas aspect)|, 0 is perfect
+}
+
+func layout_coverage(snapset *SnapshotSet, width int, height int) float64 {
+	// Fraction of the canvas covered by photos, 0 if there's no canvas
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	return float64(photo_area(snapset)) / (float64(width) * float64(height))
+}
+
+func photo_area(snapset *SnapshotSet) int64 {
+	var area int64
+	for _, snap := range snapset.Snaps {
+		area += int64(snap.Width) * int64(snap.Height)
+	}
+	return area
+}
+
+func (snapset *SnapshotSet) bounding_box() (min_x int32, min_y int32, max_x int32, max_y int32) {
+	if len(snapset.Snaps) == 0 {
+		return 0, 0, 0, 0
+	}
+	min_x, min_y = math.MaxInt32, math.MaxInt32
+	max_x, max_y = math.MinInt32, math.MinInt32
+	for _, snap := range snapset.Snaps {
+		if snap.X < min_x {
+			min_x = snap.X
+		}
+		if snap.Y < min_y {
+			min_y = snap.Y
+		}
+		if snap.X+snap.Width > max_x {
+			max_x = snap.X + snap.Width
+		}
+		if snap.Y+snap.Height > max_y {
+			max_y = snap.Y + snap.Height
+		}
+	}
+	return min_x, min_y, max_x, max_y
+}
+
+func measure_layout(snapset *SnapshotSet, originals []Snapshot, width int, height int) LayoutMetrics {
+	/*
+		snapset is the placed set on a width x height canvas
+		originals are the snapshots as they came from the photos,
+		at full size, to find how much each has been shrunk
+	*/
+	area := photo_area(snapset)
+	min_x, min_y, max_x, max_y := snapset.bounding_box()
+	box_area := int64(max_x-min_x) * int64(max_y-min_y)
+
+	original_widths := make(map[string]int32)
+	for _, original := range originals {
+		original_widths[original.Location] = original.Width
+	}
+	smallest_scale := 0.0
+	seen := false
+	for _, snap := range snapset.Snaps {
+		// Photos whose original width isn't known can't be compared
+		original_width := original_widths[snap.Location]
+		if original_width <= 0 {
+			continue
+		}
+		scale := float64(snap.Width) / float64(original_width)
+		if !seen || scale < smallest_scale {
+			smallest_scale = scale
+			seen = true
+		}
+	}
+
+	aspect_mismatch := 0.0
+	if box_area > 0 && width > 0 && height > 0 {
+		box_aspect := float64(max_x-min_x) / float64(max_y-min_y)
+		canvas_aspect := float64(width) / float64(height)
+		aspect_mismatch = math.Abs(math.Log(box_aspect / canvas_aspect))
+	}
+
+	return LayoutMetrics{
+		Coverage:       layout_coverage(snapset, width, height),
+		WastedMattArea: int64(width)*int64(height) - area,
+		HoleArea:       box_area - area,
+		SmallestScale:  smallest_scale,
+		AspectMismatch: aspect_mismatch,
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// The gravity packer is greedy, so what it produces depends heavily on
+// the order the images are added in. This tries every ordering when
+// there are few enough images, and otherwise searches over orderings by
+// simulated annealing until it stops finding better ones or the budget
+// runs out, packing each with the gravity packer and keeping whichever
+// covers most of the canvas.
+
+type OptimisedLayout struct {
+	budget time.Duration
+}
+
+// Up to this many images every ordering is tried, 720 of them for six
+const exhaustive_layout_images = 6
+
+// Annealing stops after this many orderings in a row find nothing better
+const layout_patience = 300
+
+func (layout OptimisedLayout) place(snapshots []Snapshot, canvas Canvas) SnapshotSet {
+	gravity := GravityLayout{}
+	if len(snapshots) < 2 {
+		return gravity.place(snapshots, canvas)
+	}
+	if len(snapshots) <= exhaustive_layout_images {
+		return layout.place_exhaustively(snapshots, canvas)
+	}
+
+	order := make([]Snapshot, len(snapshots))
+	copy(order, snapshots)
+	current_set := gravity.place(order, canvas)
+	current_score := layout_coverage(&current_set, canvas.Width, canvas.Height)
+
+	best_set := current_set
+	best_score := current_score
+
+	// Start hot enough to accept a 5% worse coverage about a third of
+	// the time, cooling to nothing by the end of the budget
+	start_temperature := 0.05
+	started := time.Now()
+	tries := 0
+	since_best := 0
+	for elapsed := time.Since(started); elapsed < layout.budget && since_best < layout_patience; elapsed = time.Since(started) {
+		tries++
+		since_best++
+		temperature := start_temperature * (1 - float64(elapsed)/float64(layout.budget))
+
+		// Neighbouring ordering, just swap a pair
+		i := rand.Intn(len(order))
+		j := rand.Intn(len(order))
+		order[i], order[j] = order[j], order[i]
+
+		candidate_set := gravity.place(order, canvas)
+		candidate_score := layout_coverage(&candidate_set, canvas.Width, canvas.Height)
+
+		worse_by := current_score - candidate_score
+		if worse_by <= 0 || (temperature > 0 && rand.Float64() < math.Exp(-worse_by/temperature)) {
+			current_score = candidate_score
+			if candidate_score > best_score {
+				best_score = candidate_score
+				best_set = candidate_set
+				since_best = 0
+			}
+		} else {
+			// Rejected, so swap them back
+			order[i], order[j] = order[j], order[i]
+		}
+	}
+	log.Printf("Optimised layout tried %d orderings in %v, best coverage %.3f\n", tries, time.Since(started).Round(time.Millisecond), best_score)
+	return best_set
+}
+
+func (layout OptimisedLayout) place_exhaustively(snapshots []Snapshot, canvas Canvas) SnapshotSet {
+	// Every ordering in turn by Heap's algorithm, each differing from the
+	// last by one swap, unless the budget runs out first
+	gravity := GravityLayout{}
+	order := make([]Snapshot, len(snapshots))
+	copy(order, snapshots)
+	best_set := gravity.place(order, canvas)
+	best_score := layout_coverage(&best_set, canvas.Width, canvas.Height)
+
+	started := time.Now()
+	tries := 1
+	counters := make([]int, len(order))
+	for i := 1; i < len(order) && time.Since(started) < layout.budget; {
+		if counters[i] >= i {
+			counters[i] = 0
+			i++
+			continue
+		}
+		if i%2 == 0 {
+			order[0], order[i] = order[i], order[0]
+		} else {
+			order[counters[i]], order[i] = order[i], order[counters[i]]
+		}
+		counters[i]++
+		i = 1
+
+		tries++
+		candidate_set := gravity.place(order, canvas)
+		if candidate_score := layout_coverage(&candidate_set, canvas.Width, canvas.Height); candidate_score > best_score {
+			best_score = candidate_score
+			best_set = candidate_set
+		}
+	}
+	log.Printf("Optimised layout tried %d orderings in %v, best coverage %.3f\n", tries, time.Since(started).Round(time.Millisecond), best_score)
+	return best_set
+}
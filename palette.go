@@ -0,0 +1,321 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// A photo's main colours, found by k-means clustering its pixels in
+// CIELAB, where distances match how different colours look, on a quickly
+// made small copy of it. Each photo's palette is kept in the photo index,
+// and a composite's is the palettes of its photos combined, which the
+// matt, the gradient background and the json all come from.
+
+type PaletteColour struct {
+	Colour MyCol   `json:"colour"`
+	Weight float64 `json:"weight"` // fraction of the photo, the palette's weights add up to 1
+}
+
+type Palette []PaletteColour
+
+const (
+	// How many colours in a palette
+	palette_size = 6
+
+	// Photos are scaled down to this many pixels on the longer side
+	palette_sample_size = 64
+
+	kmeans_iterations = 12
+
+	// Colours this close (CIE76 delta E) are merged when combining palettes
+	palette_merge_distance = 12.0
+
+	// Colours with less CIELAB chroma than this are too grey to base a matt on
+	matt_min_chroma = 15.0
+)
+
+type lab struct {
+	l, a, b float64
+}
+
+func (col MyCol) lab() lab {
+	l, a, b := col.ToLab()
+	return lab{l, a, b}
+}
+
+func (colour lab) col() MyCol {
+	return FromLab(colour.l, colour.a, colour.b)
+}
+
+func (colour lab) distance(other lab) float64 {
+	return math.Sqrt((colour.l-other.l)*(colour.l-other.l) + (colour.a-other.a)*(colour.a-other.a) + (colour.b-other.b)*(colour.b-other.b))
+}
+
+func (colour lab) chroma() float64 {
+	return math.Hypot(colour.a, colour.b)
+}
+
+func extract_palette(img image.Image) Palette {
+	small := analysis_thumbnail(img, palette_sample_size)
+	pixels := make([]lab, 0, len(small.Pix)/4)
+	for i := 0; i < len(small.Pix); i += 4 {
+		// Each 8 bit channel repeated to fill 16 bits, as ParseHexColour does
+		red, green, blue := uint64(small.Pix[i]), uint64(small.Pix[i+1]), uint64(small.Pix[i+2])
+		pixels = append(pixels, MyCol{red * 0x101, green * 0x101, blue * 0x101}.lab())
+	}
+	return kmeans_palette(pixels, palette_size)
+}
+
+func analysis_thumbnail(img image.Image, size int) *image.NRGBA {
+	/*
+		img scaled down to no more than size pixels on its longer side,
+		quickly rather than well, for working out its colours. Each pixel
+		is the average of a grid of samples from the block of img it
+		covers rather than of every pixel in it, and jpegs, decoded as
+		*image.YCbCr, are averaged straight from their Y, Cb and Cr
+		planes, so a 20MP photo takes about as long as a small one.
+	*/
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 {
+		return image.NewNRGBA(image.Rectangle{})
+	}
+	scale := math.Min(1, float64(size)/float64(max_int(width, height)))
+	small_width := max_int(1, int(math.Round(float64(width)*scale)))
+	small_height := max_int(1, int(math.Round(float64(height)*scale)))
+	small := image.NewNRGBA(image.Rect(0, 0, small_width, small_height))
+	for y := 0; y < small_height; y++ {
+		top := bounds.Min.Y + y*height/small_height
+		bottom := bounds.Min.Y + (y+1)*height/small_height
+		for x := 0; x < small_width; x++ {
+			left := bounds.Min.X + x*width/small_width
+			right := bounds.Min.X + (x+1)*width/small_width
+			pixel := small.Pix[y*small.Stride+x*4:]
+			pixel[0], pixel[1], pixel[2] = block_average(img, image.Rect(left, top, right, bottom))
+			pixel[3] = 255
+		}
+	}
+	return small
+}
+
+// Samples averaged across and down each block of a photo for a thumbnail pixel
+const thumbnail_block_samples = 4
+
+func block_average(img image.Image, block image.Rectangle) (uint8, uint8, uint8) {
+	x_step := max_int(1, block.Dx()/thumbnail_block_samples)
+	y_step := max_int(1, block.Dy()/thumbnail_block_samples)
+	var first, second, third, count int
+	switch src := img.(type) {
+	case *image.YCbCr:
+		for y := block.Min.Y; y < block.Max.Y; y += y_step {
+			for x := block.Min.X; x < block.Max.X; x += x_step {
+				first += int(src.Y[src.YOffset(x, y)])
+				c := src.COffset(x, y)
+				second += int(src.Cb[c])
+				third += int(src.Cr[c])
+				count++
+			}
+		}
+		// Converting is linear, near enough, so the average's colour is
+		// the average colour
+		return color.YCbCrToRGB(uint8(first/count), uint8(second/count), uint8(third/count))
+	case *image.NRGBA:
+		// What imaging's rotations and crops give
+		for y := block.Min.Y; y < block.Max.Y; y += y_step {
+			for x := block.Min.X; x < block.Max.X; x += x_step {
+				pixel := src.Pix[src.PixOffset(x, y):]
+				first += int(pixel[0])
+				second += int(pixel[1])
+				third += int(pixel[2])
+				count++
+			}
+		}
+	case *image.RGBA:
+		for y := block.Min.Y; y < block.Max.Y; y += y_step {
+			for x := block.Min.X; x < block.Max.X; x += x_step {
+				pixel := src.Pix[src.PixOffset(x, y):]
+				first += int(pixel[0])
+				second += int(pixel[1])
+				third += int(pixel[2])
+				count++
+			}
+		}
+	default:
+		for y := block.Min.Y; y < block.Max.Y; y += y_step {
+			for x := block.Min.X; x < block.Max.X; x += x_step {
+				r, g, b, _ := img.At(x, y).RGBA()
+				first += int(r >> 8)
+				second += int(g >> 8)
+				third += int(b >> 8)
+				count++
+			}
+		}
+	}
+	return uint8(first / count), uint8(second / count), uint8(third / count)
+}
+
+func kmeans_palette(pixels []lab, k int) Palette {
+	if len(pixels) == 0 {
+		return Palette{}
+	}
+	centres := kmeans_seeds(pixels, k)
+	assigned := make([]int, len(pixels))
+	for iteration := 0; iteration < kmeans_iterations; iteration++ {
+		changed := false
+		for i, pixel := range pixels {
+			nearest := 0
+			for c := range centres {
+				if pixel.distance(centres[c]) < pixel.distance(centres[nearest]) {
+					nearest = c
+				}
+			}
+			if assigned[i] != nearest {
+				assigned[i] = nearest
+				changed = true
+			}
+		}
+		sums := make([]lab, len(centres))
+		counts := make([]int, len(centres))
+		for i, pixel := range pixels {
+			c := assigned[i]
+			sums[c].l += pixel.l
+			sums[c].a += pixel.a
+			sums[c].b += pixel.b
+			counts[c]++
+		}
+		for c := range centres {
+			if counts[c] > 0 {
+				centres[c] = lab{sums[c].l / float64(counts[c]), sums[c].a / float64(counts[c]), sums[c].b / float64(counts[c])}
+			}
+		}
+		if !changed && iteration > 0 {
+			break
+		}
+	}
+
+	counts := make([]int, len(centres))
+	for _, c := range assigned {
+		counts[c]++
+	}
+	palette := make(Palette, 0, len(centres))
+	for c, centre := range centres {
+		if counts[c] > 0 {
+			palette = append(palette, PaletteColour{centre.col(), float64(counts[c]) / float64(len(pixels))})
+		}
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Weight > palette[j].Weight })
+	return palette
+}
+
+func kmeans_seeds(pixels []lab, k int) []lab {
+	// k-means++, each seed picked with a chance proportional to its
+	// squared distance from those already picked. Seeded the same every
+	// time so a photo always gets the same palette
+	random := rand.New(rand.NewSource(1))
+	centres := []lab{pixels[random.Intn(len(pixels))]}
+	nearest := make([]float64, len(pixels))
+	for len(centres) < k {
+		total := 0.0
+		for i, pixel := range pixels {
+			distance := pixel.distance(centres[len(centres)-1])
+			if len(centres) == 1 || distance*distance < nearest[i] {
+				nearest[i] = distance * distance
+			}
+			total += nearest[i]
+		}
+		if total == 0 {
+			// Fewer distinct colours than k
+			break
+		}
+		target := random.Float64() * total
+		chosen := len(pixels) - 1
+		for i, distance := range nearest {
+			target -= distance
+			if target < 0 {
+				chosen = i
+				break
+			}
+		}
+		centres = append(centres, pixels[chosen])
+	}
+	return centres
+}
+
+func combine_palettes(palettes []Palette, weights []float64) Palette {
+	/*
+		One palette for several photos, each counting for as much as its
+		weight e.g. the area it's shown at, with colours close enough to
+		look alike merged together
+	*/
+	type cluster struct {
+		sum    lab // weighted
+		weight float64
+	}
+	everything := make([]PaletteColour, 0)
+	total := 0.0
+	for i, palette := range palettes {
+		for _, colour := range palette {
+			weight := weights[i] * colour.Weight
+			everything = append(everything, PaletteColour{colour.Colour, weight})
+			total += weight
+		}
+	}
+	if total == 0 {
+		return Palette{}
+	}
+	sort.SliceStable(everything, func(i, j int) bool { return everything[i].Weight > everything[j].Weight })
+
+	clusters := make([]cluster, 0)
+	for _, colour := range everything {
+		colour_lab := colour.Colour.lab()
+		merged := false
+		for c := range clusters {
+			centre := lab{clusters[c].sum.l / clusters[c].weight, clusters[c].sum.a / clusters[c].weight, clusters[c].sum.b / clusters[c].weight}
+			if centre.distance(colour_lab) < palette_merge_distance {
+				clusters[c].sum.l += colour_lab.l * colour.Weight
+				clusters[c].sum.a += colour_lab.a * colour.Weight
+				clusters[c].sum.b += colour_lab.b * colour.Weight
+				clusters[c].weight += colour.Weight
+				merged = true
+				break
+			}
+		}
+		if !merged && colour.Weight > 0 {
+			clusters = append(clusters, cluster{lab{colour_lab.l * colour.Weight, colour_lab.a * colour.Weight, colour_lab.b * colour.Weight}, colour.Weight})
+		}
+	}
+
+	combined := make(Palette, 0, len(clusters))
+	for _, c := range clusters {
+		centre := lab{c.sum.l / c.weight, c.sum.a / c.weight, c.sum.b / c.weight}
+		combined = append(combined, PaletteColour{centre.col(), c.weight / total})
+	}
+	sort.SliceStable(combined, func(i, j int) bool { return combined[i].Weight > combined[j].Weight })
+	if len(combined) > palette_size {
+		combined = combined[:palette_size]
+	}
+	return combined
+}
+
+func (palette Palette) saturated() []MyCol {
+	// The palette's colours with enough colour in them to base a matt on,
+	// commonest first
+	colours := make([]MyCol, 0, len(palette))
+	for _, colour := range palette {
+		if colour.Colour.lab().chroma() >= matt_min_chroma {
+			colours = append(colours, colour.Colour)
+		}
+	}
+	return colours
+}
+
+func (palette Palette) dominant() *MyCol {
+	// The commonest colour that isn't too grey, nil if they all are
+	if saturated := palette.saturated(); len(saturated) > 0 {
+		return &saturated[0]
+	}
+	return nil
+}
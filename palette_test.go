@@ -0,0 +1,181 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	// A 20MP jpeg as decoded, made once for all the benchmarks
+	large_photo      *image.YCbCr
+	large_photo_once sync.Once
+)
+
+func synthetic_photo(width int, height int) *image.YCbCr {
+	// Sky over grass with a red subject, so there's a palette to find
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	ycbcr := func(r uint8, g uint8, b uint8) color.YCbCr {
+		y, cb, cr := color.RGBToYCbCr(r, g, b)
+		return color.YCbCr{Y: y, Cb: cb, Cr: cr}
+	}
+	sky := ycbcr(120, 150, 200)
+	grass := ycbcr(60, 130, 50)
+	subject := ycbcr(210, 40, 40)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			colour := sky
+			if y > height*3/5 {
+				colour = grass
+			}
+			if x > width/3 && x < width/2 && y > height/3 && y < height*4/5 {
+				colour = subject
+			}
+			img.Y[img.YOffset(x, y)] = colour.Y
+			c := img.COffset(x, y)
+			img.Cb[c] = colour.Cb
+			img.Cr[c] = colour.Cr
+		}
+	}
+	return img
+}
+
+func twenty_megapixels() *image.YCbCr {
+	large_photo_once.Do(func() {
+		large_photo = synthetic_photo(5472, 3648)
+	})
+	return large_photo
+}
+
+func TestExtractPalette(t *testing.T) {
+	palette := extract_palette(synthetic_photo(600, 400))
+	total := 0.0
+	for _, colour := range palette {
+		total += colour.Weight
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("weights add up to %v, want 1", total)
+	}
+	if len(palette) == 0 || palette[0].Colour.lab().distance(MyCol{120 * 0x101, 150 * 0x101, 200 * 0x101}.lab()) > 5 {
+		t.Errorf("commonest colour %+v, want the sky", palette)
+	}
+	dominant := palette.dominant()
+	if dominant == nil {
+		t.Fatal("no dominant colour")
+	}
+}
+
+func TestAnalysisThumbnail(t *testing.T) {
+	photo := synthetic_photo(600, 400)
+	tests := []struct {
+		name  string
+		img   image.Image
+		width int
+	}{
+		{"ycbcr", photo, 64},
+		{"nrgba", imaging.Clone(photo), 64},
+		{"rgba", to_rgba(photo), 64},
+		{"gray", image.NewGray(image.Rect(0, 0, 600, 400)), 64},
+		{"smaller than the thumbnail", imaging.Resize(photo, 30, 20, imaging.Box), 30},
+	}
+	for _, test := range tests {
+		small := analysis_thumbnail(test.img, 64)
+		if small.Bounds().Dx() != test.width {
+			t.Errorf("%v: %v wide, want %v", test.name, small.Bounds().Dx(), test.width)
+		}
+		// Every way of reading the photo should see the same sky
+		if test.name != "gray" {
+			r, g, b, _ := small.At(0, 0).RGBA()
+			if math.Abs(float64(r>>8)-120) > 3 || math.Abs(float64(g>>8)-150) > 3 || math.Abs(float64(b>>8)-200) > 3 {
+				t.Errorf("%v: top left is %v %v %v, want the sky", test.name, r>>8, g>>8, b>>8)
+			}
+		}
+	}
+	if empty := analysis_thumbnail(image.NewNRGBA(image.Rectangle{}), 64); !empty.Bounds().Empty() {
+		t.Errorf("empty photo gave a %v thumbnail", empty.Bounds())
+	}
+}
+
+func to_rgba(img image.Image) *image.RGBA {
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+func BenchmarkExtractPaletteImagingFit(b *testing.B) {
+	// The thumbnail made as the rest of the server does, with imaging
+	img := twenty_megapixels()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		extract_palette(imaging.Fit(img, palette_sample_size, palette_sample_size, imaging.Box))
+	}
+}
+
+func BenchmarkExtractPaletteAnalysisThumbnail(b *testing.B) {
+	img := twenty_megapixels()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		extract_palette(img)
+	}
+}
+
+func full_resolution_summary(img image.Image) ([]int, []MyCol, *image.RGBA) {
+	// The analysis as it was before thumbnails: a saturation histogram
+	// over every pixel through At, then a second pass over every pixel
+	// averaging the top 2.4% most saturated into eight colour buckets
+	bounds := img.Bounds()
+	saturation_buckets := make([]int, 64)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			saturation_buckets[(largest(r, g, b)-smallest(r, g, b))>>10]++
+		}
+	}
+
+	target_count := int(0.024 * float64(bounds.Dx()) * float64(bounds.Dy()))
+	min_bucket_to_count := len(saturation_buckets)
+	cumm_count := 0
+	for i := len(saturation_buckets) - 1; i > -1; i-- {
+		cumm_count += saturation_buckets[i]
+		if cumm_count >= target_count {
+			min_bucket_to_count = i
+			break
+		}
+	}
+	threshold := uint32(min_bucket_to_count << 10)
+
+	copied := image.NewRGBA(bounds)
+	counts_by_color := make([]int, 8)
+	total_color_vals := make([]MyCol, 8)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			if largest(r, g, b)-smallest(r, g, b) > threshold {
+				three_bit_color := (r>>15)<<2 + (g>>15)<<1 + b>>15
+				counts_by_color[three_bit_color]++
+				total_color_vals[three_bit_color] = total_color_vals[three_bit_color].Add(MyCol{uint64(r), uint64(g), uint64(b)})
+			}
+			copied.SetRGBA(x, y, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255})
+		}
+	}
+	for i := range total_color_vals {
+		if counts_by_color[i] > 0 {
+			total_color_vals[i] = total_color_vals[i].Divide(counts_by_color[i])
+		}
+	}
+	return counts_by_color, total_color_vals, copied
+}
+
+func BenchmarkFullResolutionAnalysis(b *testing.B) {
+	// What the thumbnail replaced, for comparison with the two above
+	img := twenty_megapixels()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		full_resolution_summary(img)
+	}
+}
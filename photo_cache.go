@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache of resized photographs, so that repeated layouts can serve
+// thumbnails without decoding and resizing the originals every time.
+// Variants are held in memory (the most recent, up to max_entries and
+// max_memory_bytes) and on disc in dir (up to max_disc_bytes, the least
+// recently used going first),
+// keyed by filename + size + modification time of the original
+// so an edited photo never serves a stale thumbnail.
+
+type ResizeCache struct {
+	mutex            sync.Mutex
+	dir              string
+	max_entries      int
+	entries          map[string][]byte
+	order            []string // keys, oldest first, for eviction from memory
+	max_memory_bytes int64
+	memory_bytes     int64 // held in entries
+	max_disc_bytes   int64
+	disc_bytes       int64 // roughly, what's in dir
+	trim_mutex       sync.Mutex
+}
+
+func NewResizeCache(dir string, max_entries int, max_memory_bytes int64, max_disc_bytes int64) *ResizeCache {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		// Still usable, just without the disc layer
+		log.Printf("Couldn't create the resize cache directory %v: %v\n", dir, err)
+	}
+	cache := &ResizeCache{
+		dir:              dir,
+		max_entries:      max_entries,
+		max_memory_bytes: max_memory_bytes,
+		entries:          make(map[string][]byte),
+		max_disc_bytes:   max_disc_bytes,
+	}
+	cache.trim_disc()
+	return cache
+}
+
+func resize_cache_key(filename string, width int, height int, format TileFormat, mod_time time.Time, notes_time time.Time) string {
+	// filenames can contain characters we don't want in a cache filename
+	// so the key is a hash of the filename, to find all of a photo's
+	// variants, then a hash of everything that identifies this variant,
+	// including when its notes changed as they can rotate and crop it
+	size := strconv.Itoa(width)
+	if height > 0 {
+		size += "x" + strconv.Itoa(height)
+	}
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%v|%d|%d", filename, size, format, mod_time.UnixNano(), notes_time.UnixNano())))
+	return resize_cache_prefix(filename) + hex.EncodeToString(hash[:])
+}
+
+func resize_cache_prefix(filename string) string {
+	hash := sha1.Sum([]byte(filename))
+	return hex.EncodeToString(hash[:8]) + "_"
+}
+
+func (cache *ResizeCache) fetch(image_path string, filename string, width int, height int, format TileFormat) ([]byte, error) {
+	/*
+		Returns the encoded bytes of the photo filename in image_path
+		resized to width pixels wide, and cropped to height pixels high
+		unless that's 0, from memory, disc or by resizing the original,
+		in that order of preference
+	*/
+	info, err := os.Stat(image_path + filename)
+	if err != nil {
+		return nil, err
+	}
+	_, notes_time := load_notes(image_path, filename)
+	key := resize_cache_key(filename, width, height, format, info.ModTime(), notes_time)
+
+	cache.mutex.Lock()
+	encoded, found := cache.entries[key]
+	cache.mutex.Unlock()
+	if found {
+		return encoded, nil
+	}
+
+	disc_name := filepath.Join(cache.dir, key+"."+format.Name)
+	encoded, err = os.ReadFile(disc_name)
+	if err == nil {
+		// Marked as used, so it's kept ahead of variants nobody asks for
+		now := time.Now()
+		os.Chtimes(disc_name, now, now)
+		cache.remember(key, encoded)
+		return encoded, nil
+	}
+
+	img, err := fetch_and_resize_image_from_file(image_path, filename, width, height)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err = format.encode(img)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := write_atomically(disc_name, encoded); err != nil {
+		log.Printf("Couldn't write resized image to the cache: %v\n", err)
+	} else {
+		cache.mutex.Lock()
+		cache.disc_bytes += int64(len(encoded))
+		over := cache.disc_bytes > cache.max_disc_bytes
+		cache.mutex.Unlock()
+		if over {
+			cache.trim_disc()
+		}
+	}
+	cache.remember(key, encoded)
+	return encoded, nil
+}
+
+func write_atomically(name string, contents []byte) error {
+	/*
+		Written to a temporary file alongside first, so neither another
+		request reading it nor a crash can ever see half of it. The
+		temporary name is unique, as two requests can resize the same
+		variant at once
+	*/
+	file, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(contents)
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), name)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (cache *ResizeCache) remember(key string, encoded []byte) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if _, found := cache.entries[key]; found {
+		return
+	}
+	if int64(len(encoded)) > cache.max_memory_bytes/4 {
+		// So big it would push out much of everything else, so it's
+		// left to the disc
+		return
+	}
+	cache.entries[key] = encoded
+	cache.memory_bytes += int64(len(encoded))
+	cache.order = append(cache.order, key)
+	for len(cache.order) > cache.max_entries || cache.memory_bytes > cache.max_memory_bytes {
+		cache.memory_bytes -= int64(len(cache.entries[cache.order[0]]))
+		delete(cache.entries, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+}
+
+func (cache *ResizeCache) trim_disc() {
+	/*
+		Removes the least recently used variants from dir until it's
+		back to three quarters of max_disc_bytes, if it's over, so a
+		whole batch goes at once rather than one per new variant
+	*/
+	cache.trim_mutex.Lock()
+	defer cache.trim_mutex.Unlock()
+	listing, err := os.ReadDir(cache.dir)
+	if err != nil {
+		return
+	}
+	files := make([]os.FileInfo, 0, len(listing))
+	var total int64
+	for _, entry := range listing {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(info.Name(), ".tmp") && time.Since(info.ModTime()) > time.Hour {
+			// Left behind by a crash part way through writing
+			os.Remove(filepath.Join(cache.dir, info.Name()))
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	if total > cache.max_disc_bytes {
+		sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+		removed := 0
+		for _, info := range files {
+			if total <= cache.max_disc_bytes*3/4 {
+				break
+			}
+			if err := os.Remove(filepath.Join(cache.dir, info.Name())); err != nil {
+				log.Printf("Couldn't remove %v from the cache: %v\n", info.Name(), err)
+				continue
+			}
+			total -= info.Size()
+			removed++
+		}
+		log.Printf("Removed %d resized images from the cache, %d bytes left\n", removed, total)
+	}
+
+	cache.mutex.Lock()
+	cache.disc_bytes = total
+	cache.mutex.Unlock()
+}
+
+func (cache *ResizeCache) forget(filename string) {
+	// Drops every variant of filename, from memory and disc
+	prefix := resize_cache_prefix(filename)
+
+	cache.mutex.Lock()
+	kept := cache.order[:0]
+	for _, key := range cache.order {
+		if strings.HasPrefix(key, prefix) {
+			cache.memory_bytes -= int64(len(cache.entries[key]))
+			delete(cache.entries, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	cache.order = kept
+	cache.mutex.Unlock()
+
+	on_disc, err := filepath.Glob(filepath.Join(cache.dir, prefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, disc_name := range on_disc {
+		info, err := os.Stat(disc_name)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(disc_name); err != nil {
+			log.Printf("Couldn't remove %v from the cache: %v\n", disc_name, err)
+			continue
+		}
+		cache.mutex.Lock()
+		cache.disc_bytes -= info.Size()
+		cache.mutex.Unlock()
+	}
+}
+
+func (cache *ResizeCache) follow(events <-chan PhotoEvent) {
+	// Forgets photos as they change or go, for as long as events keep coming
+	for event := range events {
+		if event.Kind != PhotoAdded {
+			cache.forget(event.Filename)
+		}
+	}
+}
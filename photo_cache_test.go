@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomically(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "variant.jpeg")
+	for _, contents := range [][]byte{[]byte("first"), []byte("second, longer")} {
+		if err := write_atomically(name, contents); err != nil {
+			t.Fatal(err)
+		}
+		written, err := os.ReadFile(name)
+		if err != nil || !bytes.Equal(written, contents) {
+			t.Errorf("read back %q, %v, want %q", written, err, contents)
+		}
+	}
+	listing, _ := os.ReadDir(dir)
+	if len(listing) != 1 {
+		t.Errorf("%d files left in the cache, want just the variant", len(listing))
+	}
+	if err := write_atomically(filepath.Join(dir, "missing", "variant.jpeg"), nil); err == nil {
+		t.Error("wrote into a directory that isn't there")
+	}
+}
+
+func TestRememberByteLimit(t *testing.T) {
+	cache := &ResizeCache{dir: t.TempDir(), max_entries: 10, max_memory_bytes: 1000, entries: make(map[string][]byte)}
+	key := func(filename string) string { return resize_cache_prefix(filename) + "variant" }
+	for _, filename := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg"} {
+		cache.remember(key(filename), make([]byte, 240))
+	}
+	if _, found := cache.entries[key("a.jpg")]; found || cache.memory_bytes != 960 || len(cache.entries) != 4 {
+		t.Errorf("holding %d bytes in %d entries, want the oldest gone", cache.memory_bytes, len(cache.entries))
+	}
+	cache.remember(key("huge.png"), make([]byte, 600))
+	if _, found := cache.entries[key("huge.png")]; found {
+		t.Error("kept an entry too big for memory")
+	}
+	cache.forget("e.jpg")
+	if cache.memory_bytes != 720 || len(cache.order) != 3 {
+		t.Errorf("holding %d bytes in %d entries after forgetting one, want 720 in 3", cache.memory_bytes, len(cache.order))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Which photos a composite can be drawn from: the albums it's pinned to
+// and when the photos were taken, going by their EXIF capture date (or
+// the date in the filename if there's no EXIF). Photos whose date isn't
+// known are left out whenever a date is asked for, and photos hidden by
+// their notes are always left out.
+
+type PhotoFilter struct {
+	Albums    []string  // anywhere if empty
+	From      time.Time // taken on or after this day, if not zero
+	To        time.Time // taken on or before this day, if not zero
+	Year      int       // taken in this year, if not 0
+	OnThisDay bool      // taken on Today's date in an earlier year
+	Today     time.Time
+}
+
+const filter_date_layout = "2006-01-02"
+
+func photo_filter_from_request(request *http.Request) (PhotoFilter, error) {
+	/*
+		?album= can be given more than once, ?mode=onthisday picks photos
+		taken on today's date in earlier years, ?from= and ?to= (either can
+		be left out) a range of dates as YYYY-MM-DD, and ?year= a whole year
+	*/
+	query := request.URL.Query()
+	filter := PhotoFilter{Albums: query["album"], Today: time.Now()}
+
+	switch query.Get("mode") {
+	case "":
+	case "onthisday":
+		filter.OnThisDay = true
+	default:
+		return PhotoFilter{}, errors.New("mode must be onthisday")
+	}
+
+	var err error
+	if text := query.Get("from"); text != "" {
+		if filter.From, err = time.Parse(filter_date_layout, text); err != nil {
+			return PhotoFilter{}, errors.New("from must be a date, YYYY-MM-DD")
+		}
+	}
+	if text := query.Get("to"); text != "" {
+		if filter.To, err = time.Parse(filter_date_layout, text); err != nil {
+			return PhotoFilter{}, errors.New("to must be a date, YYYY-MM-DD")
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return PhotoFilter{}, errors.New("to must not be before from")
+	}
+
+	if filter.Year, err = optional_int_parameter(request, "year", 0, 1800, 9999); err != nil {
+		return PhotoFilter{}, err
+	}
+	return filter, nil
+}
+
+func (filter PhotoFilter) by_date() bool {
+	return !filter.From.IsZero() || !filter.To.IsZero() || filter.Year != 0 || filter.OnThisDay
+}
+
+func (filter PhotoFilter) matches(record *PhotoRecord) bool {
+	if record.Hidden {
+		return false
+	}
+	if len(filter.Albums) > 0 && !in_albums(record.Album, filter.Albums) {
+		return false
+	}
+	if !filter.by_date() {
+		return true
+	}
+	if record.Taken.IsZero() {
+		return false
+	}
+
+	// Capture times are the camera's clock, kept as UTC, so compare
+	// calendar dates rather than instants
+	taken := record.Taken
+	day := time.Date(taken.Year(), taken.Month(), taken.Day(), 0, 0, 0, 0, time.UTC)
+	if !filter.From.IsZero() && day.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && day.After(filter.To) {
+		return false
+	}
+	if filter.Year != 0 && taken.Year() != filter.Year {
+		return false
+	}
+	if filter.OnThisDay {
+		today := filter.Today
+		if taken.Month() != today.Month() || taken.Day() != today.Day() || taken.Year() >= today.Year() {
+			return false
+		}
+	}
+	return true
+}
+
+func (filter PhotoFilter) String() string {
+	description := ""
+	if len(filter.Albums) > 0 {
+		description += fmt.Sprintf(" in albums %v", filter.Albums)
+	}
+	if !filter.From.IsZero() {
+		description += " from " + filter.From.Format(filter_date_layout)
+	}
+	if !filter.To.IsZero() {
+		description += " to " + filter.To.Format(filter_date_layout)
+	}
+	if filter.Year != 0 {
+		description += fmt.Sprintf(" in %d", filter.Year)
+	}
+	if filter.OnThisDay {
+		description += " on this day " + filter.Today.Format("2 January")
+	}
+	if description == "" {
+		return "anywhere"
+	}
+	return description[1:]
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func day(year int, month time.Month, date int) time.Time {
+	return time.Date(year, month, date, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPhotoFilterMatches(t *testing.T) {
+	today := time.Date(2024, 8, 14, 9, 0, 0, 0, time.Local)
+	skye := PhotoRecord{Album: "2019/Skye", Taken: time.Date(2019, 8, 14, 23, 59, 0, 0, time.UTC)}
+	tests := []struct {
+		name   string
+		filter PhotoFilter
+		record PhotoRecord
+		want   bool
+	}{
+		{"no filter", PhotoFilter{}, skye, true},
+		{"no filter, undated", PhotoFilter{}, PhotoRecord{}, true},
+		{"hidden", PhotoFilter{}, PhotoRecord{Album: "2019/Skye", Hidden: true}, false},
+		{"hidden though it matches", PhotoFilter{Albums: []string{"2019"}}, PhotoRecord{Album: "2019/Skye", Hidden: true}, false},
+
+		{"album", PhotoFilter{Albums: []string{"2019/Skye"}}, skye, true},
+		{"inside album", PhotoFilter{Albums: []string{"2019"}}, skye, true},
+		{"album slashes", PhotoFilter{Albums: []string{"/2019/"}}, skye, true},
+		{"album name prefix", PhotoFilter{Albums: []string{"2019/Sky"}}, skye, false},
+		{"another album", PhotoFilter{Albums: []string{"2020", "2019/Skye"}}, skye, true},
+		{"wrong album", PhotoFilter{Albums: []string{"2020"}}, skye, false},
+
+		{"from the same day", PhotoFilter{From: day(2019, 8, 14)}, skye, true},
+		{"from the day after", PhotoFilter{From: day(2019, 8, 15)}, skye, false},
+		{"to the same day, late in it", PhotoFilter{To: day(2019, 8, 14)}, skye, true},
+		{"to the day before", PhotoFilter{To: day(2019, 8, 13)}, skye, false},
+		{"in range", PhotoFilter{From: day(2019, 1, 1), To: day(2019, 12, 31)}, skye, true},
+		{"undated with a date asked for", PhotoFilter{From: day(2019, 1, 1)}, PhotoRecord{Album: "2019/Skye"}, false},
+
+		{"year", PhotoFilter{Year: 2019}, skye, true},
+		{"wrong year", PhotoFilter{Year: 2020}, skye, false},
+		{"year and album", PhotoFilter{Year: 2019, Albums: []string{"2020"}}, skye, false},
+
+		{"on this day", PhotoFilter{OnThisDay: true, Today: today}, skye, true},
+		{"on this day, this year", PhotoFilter{OnThisDay: true, Today: today}, PhotoRecord{Taken: time.Date(2024, 8, 14, 8, 0, 0, 0, time.UTC)}, false},
+		{"on another day", PhotoFilter{OnThisDay: true, Today: today}, PhotoRecord{Taken: time.Date(2019, 8, 15, 0, 0, 0, 0, time.UTC)}, false},
+		{"on this day, leap day", PhotoFilter{OnThisDay: true, Today: day(2024, 2, 29)}, PhotoRecord{Taken: day(2020, 2, 29)}, true},
+		{"on this day, undated", PhotoFilter{OnThisDay: true, Today: today}, PhotoRecord{}, false},
+	}
+	for _, test := range tests {
+		record := test.record
+		if got := test.filter.matches(&record); got != test.want {
+			t.Errorf("%v: matches = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPhotoFilterFromRequest(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string // the filter's String()
+		wantErr bool
+	}{
+		{"", "anywhere", false},
+		{"album=2019&album=2020", "in albums [2019 2020]", false},
+		{"from=2019-08-01&to=2019-08-31", "from 2019-08-01 to 2019-08-31", false},
+		{"from=2019-08-01&to=2019-08-01", "from 2019-08-01 to 2019-08-01", false},
+		{"to=2019-08-31", "to 2019-08-31", false},
+		{"year=2019", "in 2019", false},
+		{"from=2019-08-31&to=2019-08-01", "", true},
+		{"from=31/08/2019", "", true},
+		{"to=yesterday", "", true},
+		{"year=19", "", true},
+		{"year=twenty", "", true},
+		{"mode=random", "", true},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/composite_map/?"+test.query, nil)
+		filter, err := photo_filter_from_request(request)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: error %v, want error %v", test.query, err, test.wantErr)
+			continue
+		}
+		if err == nil && filter.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.query, filter.String(), test.want)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/composite_map/?mode=onthisday", nil)
+	if filter, err := photo_filter_from_request(request); err != nil || !filter.OnThisDay {
+		t.Errorf("mode=onthisday: got %+v, %v", filter, err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Persistent index of the photo library, so that handlers don't have to
+// glob the photos directory and decode every chosen image on each
+// request just to find out its size and matt colour. It's saved as
+// json, and on startup only photos that are new or have changed since
+// it was last saved are analysed again.
+//
+// Photos can be in nested folders, each of which is an album, and are
+// known by their path relative to the photos directory, always with
+// forward slashes e.g. "2019/Skye/IMG_0042.jpg" is in album "2019/Skye"
+
+type PhotoRecord struct {
+	Filename string    `json:"filename"`
+	Album    string    `json:"album"` // "" for the top level
+	Width    int32     `json:"width"` // after EXIF orientation
+	Height   int32     `json:"height"`
+	ModTime  time.Time `json:"mod_time"`
+	Size     int64     `json:"size"`
+	Hash     string    `json:"hash"`    // sha1 of the file
+	Palette  Palette   `json:"palette"` // to find a matt for several photos
+	Taken    time.Time `json:"taken"`   // zero if not known
+	GPS      *GeoPoint `json:"gps,omitempty"`
+	Camera   string    `json:"camera,omitempty"`
+	Faces    []FaceBox `json:"faces,omitempty"`
+	FacesBy  string    `json:"faces_by,omitempty"` // face_finder_id() when they were looked for
+
+	// From the photo's sidecar and album.json files
+	Caption   string    `json:"caption,omitempty"`
+	Favourite bool      `json:"favourite,omitempty"`
+	Hidden    bool      `json:"hidden,omitempty"`
+	NotesTime time.Time `json:"notes_time"` // when they last changed
+
+	Version int `json:"version"`
+}
+
+// Records analysed by an older version of the server than this are
+// analysed again, so they pick up whatever has been added since
+const photo_record_version = 9
+
+type PhotoIndex struct {
+	mutex       sync.RWMutex
+	scan_mutex  sync.Mutex // only one refresh at a time
+	index_file  string
+	image_path  string
+	photos      map[string]*PhotoRecord
+	subscribers []chan PhotoEvent
+}
+
+func NewPhotoIndex(index_file string, image_path string) *PhotoIndex {
+	// Starts from whatever was last saved in index_file, if anything
+	index := &PhotoIndex{
+		index_file: index_file,
+		image_path: image_path,
+		photos:     make(map[string]*PhotoRecord),
+	}
+	saved, err := os.ReadFile(index_file)
+	if err != nil {
+		log.Printf("No saved photo index, starting afresh: %v\n", err)
+		return index
+	}
+	records := make([]*PhotoRecord, 0)
+	if err := json.Unmarshal(saved, &records); err != nil {
+		log.Printf("Ignoring unreadable photo index %v: %v\n", index_file, err)
+		return index
+	}
+	for _, record := range records {
+		index.photos[record.Filename] = record
+	}
+	log.Printf("Loaded %d photos from the index\n", len(index.photos))
+	return index
+}
+
+func (index *PhotoIndex) refresh() error {
+	/*
+		Brings the index up to date with the photos directory, analysing
+		new and changed photos and forgetting ones that have gone, then
+		saves it if anything changed, telling subscribers about each change
+	*/
+	index.scan_mutex.Lock()
+	defer index.scan_mutex.Unlock()
+
+	on_disc, err := find_photos(index.image_path)
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	present := make(map[string]bool)
+	for _, filename := range on_disc {
+		present[filename] = true
+		path := index.image_path + filename
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Couldn't stat %v: %v\n", path, err)
+			continue
+		}
+
+		index.mutex.RLock()
+		record, found := index.photos[filename]
+		index.mutex.RUnlock()
+		_, notes_time := load_notes(index.image_path, filename)
+		unchanged := found && record.ModTime.Equal(info.ModTime()) && record.Size == info.Size() && record.NotesTime.Equal(notes_time)
+		if unchanged && record.Version >= photo_record_version && record.FacesBy == face_finder_id() {
+			continue
+		}
+		event := PhotoEvent{PhotoAdded, filename}
+		if found {
+			event.Kind = PhotoChanged
+		}
+
+		record, err = analyse_photo(index.image_path, filename, info)
+		if err != nil {
+			log.Printf("IGNORING BAD FILE: %v\n", filename)
+			if found {
+				// It was fine before, but isn't now
+				delete(present, filename)
+			}
+			continue
+		}
+		index.mutex.Lock()
+		index.photos[filename] = record
+		index.mutex.Unlock()
+		if !unchanged {
+			// Only the record is new, the photo is shown just as it was
+			index.publish(event)
+		}
+
+		// Save as we go, so a big first scan isn't lost if we're stopped
+		changed++
+		if changed%50 == 0 {
+			log.Printf("Indexed %d photos so far\n", changed)
+			index.save()
+		}
+	}
+
+	index.mutex.Lock()
+	removed := make([]string, 0)
+	for filename := range index.photos {
+		if !present[filename] {
+			delete(index.photos, filename)
+			removed = append(removed, filename)
+		}
+	}
+	index.mutex.Unlock()
+	for _, filename := range removed {
+		index.publish(PhotoEvent{PhotoRemoved, filename})
+		changed++
+	}
+
+	if changed > 0 {
+		log.Printf("Photo index updated, %d changes\n", changed)
+		return index.save()
+	}
+	return nil
+}
+
+func find_photos(image_path string) ([]string, error) {
+	// The path, relative to image_path, of every photo in it or any
+	// folder inside it, skipping hidden folders
+	filenames := make([]string, 0)
+	err := filepath.WalkDir(image_path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Couldn't look in %v: %v\n", path, err)
+			return nil
+		}
+		if entry.IsDir() {
+			if path != filepath.Clean(image_path) && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !is_photo_file(entry.Name()) {
+			return nil
+		}
+		relative, err := filepath.Rel(image_path, path)
+		if err != nil {
+			return err
+		}
+		filenames = append(filenames, filepath.ToSlash(relative))
+		return nil
+	})
+	return filenames, err
+}
+
+// Everything image.Decode can read, with the decoders imaging and
+// golang.org/x/image/webp register. HEIC isn't, there's no pure Go decoder
+var photo_extensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+	".webp": true,
+}
+
+func is_photo_file(name string) bool {
+	return photo_extensions[strings.ToLower(filepath.Ext(name))]
+}
+
+func album_of(filename string) string {
+	album := path.Dir(filename)
+	if album == "." {
+		return ""
+	}
+	return album
+}
+
+func in_albums(album string, albums []string) bool {
+	// Whether album is one of albums, or inside one of them
+	for _, wanted := range albums {
+		wanted = strings.Trim(wanted, "/")
+		if album == wanted || strings.HasPrefix(album, wanted+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func analyse_photo(image_path string, filename string, info os.FileInfo) (*PhotoRecord, error) {
+	// Everything the index records about a single photo
+	hash, err := hash_file(image_path + filename)
+	if err != nil {
+		return nil, err
+	}
+	notes, notes_time := load_notes(image_path, filename)
+	img, err := fetch_image_from_file(image_path, filename)
+	if err != nil {
+		return nil, err
+	}
+	palette := extract_palette(img)
+	exif, err := read_exif(image_path + filename)
+	if err != nil {
+		exif = ExifData{}
+	}
+	if exif.Taken.IsZero() {
+		exif.Taken, _ = time_from_filename(filename)
+	}
+	return &PhotoRecord{
+		Filename: filename,
+		Album:    album_of(filename),
+		Width:    int32(img.Bounds().Dx()),
+		Height:   int32(img.Bounds().Dy()),
+		ModTime:  info.ModTime(),
+		Size:     info.Size(),
+		Hash:     hash,
+		Palette:  palette,
+		Taken:    exif.Taken,
+		GPS:      exif.GPS,
+		Camera:   exif.Camera,
+		Faces:    detect_faces(img),
+		FacesBy:  face_finder_id(),
+
+		Caption:   notes.Caption,
+		Favourite: notes.is_favourite(),
+		Hidden:    notes.is_hidden(),
+		NotesTime: notes_time,
+
+		Version: photo_record_version,
+	}, nil
+}
+
+func hash_file(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (index *PhotoIndex) save() error {
+	// Written to a temporary file first so a crash can't leave half an index
+	index.mutex.RLock()
+	records := make([]*PhotoRecord, 0, len(index.photos))
+	for _, record := range index.photos {
+		records = append(records, record)
+	}
+	index.mutex.RUnlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Filename < records[j].Filename })
+
+	encoded, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	temporary := index.index_file + ".tmp"
+	if err := os.WriteFile(temporary, encoded, 0644); err != nil {
+		log.Printf("Couldn't save the photo index: %v\n", err)
+		return err
+	}
+	return os.Rename(temporary, index.index_file)
+}
+
+func (index *PhotoIndex) records(filter PhotoFilter) []PhotoRecord {
+	// Copies of the records of all the photos the filter lets through,
+	// in filename order
+	index.mutex.RLock()
+	records := make([]PhotoRecord, 0, len(index.photos))
+	for _, record := range index.photos {
+		if filter.matches(record) {
+			records = append(records, *record)
+		}
+	}
+	index.mutex.RUnlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Filename < records[j].Filename })
+	return records
+}
+
+func (index *PhotoIndex) albums() []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	seen := make(map[string]bool)
+	for _, record := range index.photos {
+		seen[record.Album] = true
+	}
+	albums := make([]string, 0, len(seen))
+	for album := range seen {
+		albums = append(albums, album)
+	}
+	sort.Strings(albums)
+	return albums
+}
+
+func (index *PhotoIndex) lookup(filename string) (PhotoRecord, error) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	record, found := index.photos[filename]
+	if !found {
+		return PhotoRecord{}, errors.New("not in the photo index: " + filename)
+	}
+	return *record, nil
+}
+
+func (record PhotoRecord) snapshot() Snapshot {
+	return Snapshot{
+		Width:    record.Width,
+		Height:   record.Height,
+		Location: record.Filename,
+	}
+}
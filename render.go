@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Server side rendering of a composite into a single finished image,
+// for displays that can't run the javascript in composite.html
+
+var (
+	// Matches the box-shadow of .precise in composite.html
+	shadow_colour = color.NRGBA{0, 0, 0, 102}
+	shadow_spread = 4
+	shadow_blur   = 4.0
+
+	// Matches the border colour given to each photo in composite.html
+	border_colour = color.RGBA{0xf4, 0xf1, 0xea, 255}
+
+	// Matches .caption in composite.html, as near as a bitmap font can
+	caption_background = color.NRGBA{0, 0, 0, 140}
+	caption_colour     = color.RGBA{255, 255, 255, 255}
+	caption_face       = basicfont.Face7x13
+	caption_padding    = 4
+)
+
+func compositeImageHandler(response http.ResponseWriter, request *http.Request) {
+	// Serves /composite.jpg and /composite.png, taking the same parameters as /composite_map/
+
+	snap_set, canvas, ok := composite_for_request(response, request)
+	if !ok {
+		return
+	}
+
+	img := render_composite(&snap_set, canvas, "photos/")
+
+	buffer := new(bytes.Buffer)
+	content_type := "image/jpeg"
+	var err error
+	if strings.HasSuffix(request.URL.Path, ".png") {
+		content_type = "image/png"
+		err = png.Encode(buffer, img)
+	} else {
+		err = jpeg.Encode(buffer, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		log.Printf("Unable to encode the composite: %v\n", err)
+		http.Error(response, "Couldn't encode the composite", 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", content_type)
+	response.Header().Set("Content-Length", strconv.Itoa(buffer.Len()))
+	if _, err := response.Write(buffer.Bytes()); err != nil {
+		log.Println("unable to write image.")
+	}
+}
+
+func render_composite(snap_set *SnapshotSet, canvas Canvas, image_path string) *image.RGBA {
+	/*
+		Draws every placed snapshot over the matt colour, each with a
+		soft drop shadow, cropping photos to fill their boxes with the
+		same cached variants /photograph/ serves the browser. Photos
+		which can't be read are left as plain grey boxes rather than
+		failing the lot.
+	*/
+	img := image.NewRGBA(image.Rect(0, 0, canvas.Width, canvas.Height))
+	if len(snap_set.Gradient) == 2 {
+		draw_gradient(img, snap_set.Gradient[0], snap_set.Gradient[1])
+	} else {
+		draw.Draw(img, img.Bounds(), &image.Uniform{snap_set.Matt.GetRGBA()}, image.Point{}, draw.Src)
+	}
+
+	// Shadows first, so that none fall across a neighbouring photo
+	for _, snap := range snap_set.Snaps {
+		draw_shadow(img, snap)
+	}
+
+	for _, snap := range snap_set.Snaps {
+		box := snap.getRect()
+		draw.Draw(img, box, &image.Uniform{border_colour}, image.Point{}, draw.Src)
+		inner := box.Inset(int(snap.Border))
+		if inner.Empty() {
+			continue
+		}
+
+		photo, err := fetch_rendered_photo(image_path, snap.Location, inner.Dx(), inner.Dy())
+		if err != nil {
+			log.Printf("Couldn't render %v: %v\n", snap.Location, err)
+			draw.Draw(img, inner, &image.Uniform{color.RGBA{128, 128, 128, 255}}, image.Point{}, draw.Src)
+			continue
+		}
+		draw.Draw(img, inner, photo, photo.Bounds().Min, draw.Src)
+		if snap.Caption != nil {
+			draw_caption(img, inner, snap.Caption)
+		}
+	}
+	return img
+}
+
+func fetch_rendered_photo(image_path string, filename string, width int, height int) (image.Image, error) {
+	// Cropped to fill width x height, through the resize cache like the
+	// browser's tiles, and scaled up if the original is smaller than that
+	encoded, err := resize_cache.fetch(image_path, filename, width, height, default_tile_format(filename, width))
+	if err != nil {
+		return nil, err
+	}
+	photo, _, err := image.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if photo.Bounds().Dx() != width || photo.Bounds().Dy() != height {
+		photo = imaging.Resize(photo, width, height, imaging.Lanczos)
+	}
+	return photo, nil
+}
+
+func draw_gradient(img *image.RGBA, from MyCol, to MyCol) {
+	// Diagonally from the top left to the bottom right, blending the
+	// colours as the browser's linear-gradient(135deg, ...) does
+	bounds := img.Bounds()
+	steps := bounds.Dx() + bounds.Dy() - 2
+	colours := make([]color.RGBA, steps+1)
+	for i := range colours {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		colours[i] = MyCol{
+			uint64(float64(from.Red)*(1-t) + float64(to.Red)*t),
+			uint64(float64(from.Green)*(1-t) + float64(to.Green)*t),
+			uint64(float64(from.Blue)*(1-t) + float64(to.Blue)*t),
+		}.GetRGBA()
+	}
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			img.SetRGBA(bounds.Min.X+x, bounds.Min.Y+y, colours[x+y])
+		}
+	}
+}
+
+func draw_caption(img *image.RGBA, inner image.Rectangle, caption *Caption) {
+	// Across the bottom of the photo on a dark band, each line cut short
+	// if it won't fit, and left off altogether on photos too small for it
+	lines := caption.lines()
+	line_height := caption_face.Metrics().Height.Ceil()
+	band_height := len(lines)*line_height + 2*caption_padding
+	if band_height*3 > inner.Dy() {
+		return
+	}
+	band := image.Rect(inner.Min.X, inner.Max.Y-band_height, inner.Max.X, inner.Max.Y)
+	draw.Draw(img, band, &image.Uniform{caption_background}, image.Point{}, draw.Over)
+
+	drawer := font.Drawer{Dst: img, Src: &image.Uniform{caption_colour}, Face: caption_face}
+	fits := (band.Dx() - 2*caption_padding) / caption_face.Advance
+	for i, line := range lines {
+		if runes := []rune(line); len(runes) > fits {
+			if fits < 4 {
+				return
+			}
+			line = string(runes[:fits-3]) + "..." // basicfont has no ellipsis
+		}
+		drawer.Dot = fixed.P(band.Min.X+caption_padding, band.Min.Y+caption_padding+i*line_height+caption_face.Ascent)
+		drawer.DrawString(line)
+	}
+}
+
+func draw_shadow(img *image.RGBA, snap *Snapshot) {
+	// A blurred dark rectangle, a little bigger than the photo, behind it
+	margin := shadow_spread + int(3*shadow_blur)
+	box := snap.getRect()
+	shadow := image.NewNRGBA(image.Rect(0, 0, box.Dx()+2*margin, box.Dy()+2*margin))
+	solid := image.Rect(margin-shadow_spread, margin-shadow_spread, margin+box.Dx()+shadow_spread, margin+box.Dy()+shadow_spread)
+	draw.Draw(shadow, solid, &image.Uniform{shadow_colour}, image.Point{}, draw.Src)
+	blurred := imaging.Blur(shadow, shadow_blur)
+
+	at := box.Min.Sub(image.Pt(margin, margin))
+	draw.Draw(img, blurred.Bounds().Add(at), blurred, image.Point{}, draw.Over)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Chooses which photos go into each composite. How many is drawn from
+// the configured count distribution, then photos are drawn by weight
+// (favourites, newly added and rarely shown photos being more likely)
+// from those not yet shown this cycle, all from the same event when
+// there's more than one. Once everything available has
+// been shown a new cycle starts, so nothing repeats until the whole
+// library, or album or date range, has had a turn. The history is saved so cycles
+// carry on across restarts.
+
+// When the filter lets nothing through, which the handlers answer with a 404
+var no_photos = errors.New("no photos to choose from")
+
+type ShowHistory struct {
+	Count     int       `json:"count"`
+	LastShown time.Time `json:"last_shown"`
+	ThisCycle bool      `json:"this_cycle"` // shown since the cycle began
+}
+
+type Selector struct {
+	mutex        sync.Mutex
+	config       SelectionConfig
+	history_file string
+	history      map[string]*ShowHistory
+}
+
+func NewSelector(config SelectionConfig, history_file string) *Selector {
+	selector := &Selector{
+		config:       config,
+		history_file: history_file,
+		history:      make(map[string]*ShowHistory),
+	}
+	saved, err := os.ReadFile(history_file)
+	if err != nil {
+		log.Printf("No saved show history, starting afresh: %v\n", err)
+		return selector
+	}
+	if err := json.Unmarshal(saved, &selector.history); err != nil {
+		log.Printf("Ignoring unreadable show history %v: %v\n", history_file, err)
+		selector.history = make(map[string]*ShowHistory)
+	}
+	return selector
+}
+
+func (selector *Selector) choose(index *PhotoIndex, filter PhotoFilter) ([]string, error) {
+	/*
+		Returns the filenames for a composite, from the photos the filter
+		lets through, recording them as shown
+	*/
+	records := index.records(filter)
+	if len(records) == 0 {
+		return nil, no_photos
+	}
+
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+
+	image_count := selector.choose_count()
+	if image_count > len(records) {
+		image_count = len(records)
+	}
+
+	// Start a new cycle if there aren't enough left in this one
+	unshown := make([]PhotoRecord, 0, len(records))
+	for _, record := range records {
+		if !selector.history_of(record.Filename).ThisCycle {
+			unshown = append(unshown, record)
+		}
+	}
+	if len(unshown) < image_count {
+		log.Printf("Everything has been shown, starting a new cycle\n")
+		for _, record := range records {
+			selector.history_of(record.Filename).ThisCycle = false
+		}
+		unshown = records
+	}
+
+	weights := selector.weights(unshown)
+	if image_count > 1 {
+		weights, image_count = selector.keep_to_one_event(unshown, weights, image_count)
+	}
+	image_set := make([]string, 0, image_count)
+	for len(image_set) < image_count {
+		chosen := draw_weighted(weights)
+		image_set = append(image_set, unshown[chosen].Filename)
+		weights[chosen] = 0
+	}
+
+	now := time.Now()
+	for _, filename := range image_set {
+		history := selector.history_of(filename)
+		history.Count++
+		history.LastShown = now
+		history.ThisCycle = true
+	}
+	selector.save()
+
+	log.Printf("Found image set filenames: %v\n", image_set)
+	return image_set, nil
+}
+
+func (selector *Selector) choose_count() int {
+	// Draws from the configured count distribution
+	counts := make([]int, 0, len(selector.config.CountWeights))
+	for count := range selector.config.CountWeights {
+		counts = append(counts, count)
+	}
+	sort.Ints(counts)
+	weights := make([]float64, len(counts))
+	for i, count := range counts {
+		weights[i] = selector.config.CountWeights[count]
+	}
+	count := counts[draw_weighted(weights)]
+	if count < 1 {
+		return 1
+	}
+	return count
+}
+
+func (selector *Selector) weights(records []PhotoRecord) []float64 {
+	mean_count := 0.0
+	for _, record := range records {
+		mean_count += float64(selector.history_of(record.Filename).Count)
+	}
+	mean_count /= float64(len(records))
+
+	new_since := time.Now().AddDate(0, 0, -selector.config.NewDays)
+	weights := make([]float64, len(records))
+	for i, record := range records {
+		weight := 1.0
+		if selector.is_favourite(record) {
+			weight *= selector.config.FavouriteWeight
+		}
+		if record.ModTime.After(new_since) {
+			weight *= selector.config.NewWeight
+		}
+		count := float64(selector.history_of(record.Filename).Count)
+		weight *= math.Pow((mean_count+1)/(count+1), selector.config.RarityBoost)
+		weights[i] = weight
+	}
+	return weights
+}
+
+func (selector *Selector) keep_to_one_event(records []PhotoRecord, weights []float64, image_count int) ([]float64, int) {
+	/*
+		Picks an event, by the weight of the first photo drawn from those
+		in events big enough for image_count photos, and zeroes the weights
+		of everything outside it. If no event is big enough, the biggest
+		is used with fewer photos
+	*/
+	gap := time.Duration(selector.config.EventGapHours * float64(time.Hour))
+	events := group_into_events(records, gap, selector.config.EventDistanceKm)
+
+	biggest := 0
+	for _, event := range events {
+		if len(event) > biggest {
+			biggest = len(event)
+		}
+	}
+	if biggest < image_count {
+		log.Printf("No event has %d photos left to show, using %d\n", image_count, biggest)
+		image_count = biggest
+	}
+
+	event_of := make([]int, len(records))
+	big_enough := make([]float64, len(records))
+	for e, event := range events {
+		for _, i := range event {
+			event_of[i] = e
+			if len(event) >= image_count {
+				big_enough[i] = weights[i]
+			}
+		}
+	}
+	event := events[event_of[draw_weighted(big_enough)]]
+
+	in_event := make([]float64, len(records))
+	for _, i := range event {
+		in_event[i] = weights[i]
+	}
+	return in_event, image_count
+}
+
+func (selector *Selector) is_favourite(record PhotoRecord) bool {
+	if record.Favourite {
+		return true
+	}
+	for _, favourite := range selector.config.Favourites {
+		if record.Filename == favourite {
+			return true
+		}
+	}
+	return in_albums(record.Album, selector.config.Favourites)
+}
+
+func (selector *Selector) history_of(filename string) *ShowHistory {
+	history, found := selector.history[filename]
+	if !found {
+		history = &ShowHistory{}
+		selector.history[filename] = history
+	}
+	return history
+}
+
+func (selector *Selector) save() {
+	// Only called with the mutex held
+	encoded, err := json.Marshal(selector.history)
+	if err != nil {
+		log.Printf("Couldn't encode the show history: %v\n", err)
+		return
+	}
+	temporary := selector.history_file + ".tmp"
+	if err := os.WriteFile(temporary, encoded, 0644); err != nil {
+		log.Printf("Couldn't save the show history: %v\n", err)
+		return
+	}
+	if err := os.Rename(temporary, selector.history_file); err != nil {
+		log.Printf("Couldn't save the show history: %v\n", err)
+	}
+}
+
+func (selector *Selector) follow(events <-chan PhotoEvent) {
+	// Forgets the history of photos that have gone from the library
+	for event := range events {
+		if event.Kind == PhotoRemoved {
+			selector.mutex.Lock()
+			if _, found := selector.history[event.Filename]; found {
+				delete(selector.history, event.Filename)
+				selector.save()
+			}
+			selector.mutex.Unlock()
+		}
+	}
+}
+
+func draw_weighted(weights []float64) int {
+	// Index drawn at random in proportion to weights, which mustn't all be 0
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	target := rand.Float64() * total
+	last := 0
+	for i, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		last = i
+		target -= weight
+		if target < 0 {
+			return i
+		}
+	}
+	return last
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"log"
+	"math"
+	"os"
+	"path"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Notes about photos kept alongside them, so they can be curated without
+// renaming, editing or deleting anything. A photo's own notes are in a
+// json file named after it, e.g. IMG_1234.jpg.json, and notes for every
+// photo in a folder, and the folders inside it, are in its album.json.
+// The photo's own notes win over its album's, and an inner album's over
+// an outer one's.
+//
+//	{
+//		"caption": "Granny's 80th",
+//		"favourite": true,
+//		"hide": false,
+//		"rotate": 90,
+//		"crop": {"left": 0.1, "top": 0, "right": 0.9, "bottom": 1}
+//	}
+//
+// rotate is clockwise degrees, after any EXIF orientation, and crop
+// gives the part of the (rotated) photo to keep, as fractions of its
+// width and height. Both change the photo everywhere it's used, so the
+// layouts see its cropped shape.
+
+type Sidecar struct {
+	Caption   string   `json:"caption,omitempty"`
+	Favourite *bool    `json:"favourite,omitempty"`
+	Hide      *bool    `json:"hide,omitempty"`
+	Rotate    *int     `json:"rotate,omitempty"`
+	Crop      *CropBox `json:"crop,omitempty"`
+}
+
+type CropBox struct {
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+	Right  float64 `json:"right"`
+	Bottom float64 `json:"bottom"`
+}
+
+const album_notes_filename = "album.json"
+
+func sidecar_filename(filename string) string {
+	return filename + ".json"
+}
+
+func load_sidecar(filename string) (Sidecar, time.Time, error) {
+	// An empty sidecar if there isn't one, and when it was last changed
+	sidecar := Sidecar{}
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return sidecar, time.Time{}, nil
+	}
+	if err != nil {
+		return sidecar, time.Time{}, err
+	}
+	saved, err := os.ReadFile(filename)
+	if err != nil {
+		return sidecar, info.ModTime(), err
+	}
+	err = json.Unmarshal(saved, &sidecar)
+	return sidecar, info.ModTime(), err
+}
+
+func load_notes(image_path string, filename string) (Sidecar, time.Time) {
+	/*
+		Everything the album.json files above a photo and its own sidecar
+		say about it, and the latest time any of them changed, so the index
+		can tell when to look again. Unreadable files are logged and skipped
+	*/
+	sources := make([]string, 0)
+	for album := album_of(filename); ; album = album_of(album) {
+		sources = append([]string{path.Join(album, album_notes_filename)}, sources...)
+		if album == "" {
+			break
+		}
+	}
+	sources = append(sources, sidecar_filename(filename))
+
+	notes := Sidecar{}
+	latest := time.Time{}
+	for _, source := range sources {
+		sidecar, changed, err := load_sidecar(image_path + source)
+		if changed.After(latest) {
+			latest = changed
+		}
+		if err != nil {
+			log.Printf("Ignoring unreadable notes %v: %v\n", source, err)
+			continue
+		}
+		notes.override(sidecar)
+	}
+	return notes, latest
+}
+
+func (notes *Sidecar) override(other Sidecar) {
+	if other.Caption != "" {
+		notes.Caption = other.Caption
+	}
+	if other.Favourite != nil {
+		notes.Favourite = other.Favourite
+	}
+	if other.Hide != nil {
+		notes.Hide = other.Hide
+	}
+	if other.Rotate != nil {
+		notes.Rotate = other.Rotate
+	}
+	if other.Crop != nil {
+		notes.Crop = other.Crop
+	}
+}
+
+func (notes Sidecar) is_favourite() bool {
+	return notes.Favourite != nil && *notes.Favourite
+}
+
+func (notes Sidecar) is_hidden() bool {
+	return notes.Hide != nil && *notes.Hide
+}
+
+func (notes Sidecar) apply(img image.Image, filename string) image.Image {
+	// The photo as its notes say it should be shown, ignoring (with a
+	// log) a rotation or crop that doesn't make sense
+	if notes.Rotate != nil {
+		switch ((*notes.Rotate % 360) + 360) % 360 {
+		case 0:
+		case 90:
+			img = imaging.Rotate270(img) // imaging rotates anticlockwise
+		case 180:
+			img = imaging.Rotate180(img)
+		case 270:
+			img = imaging.Rotate90(img)
+		default:
+			log.Printf("Ignoring rotation of %v, not a multiple of 90: %v\n", filename, *notes.Rotate)
+		}
+	}
+	if crop := notes.Crop; crop != nil {
+		if crop.Left < 0 || crop.Top < 0 || crop.Right > 1 || crop.Bottom > 1 || crop.Left >= crop.Right || crop.Top >= crop.Bottom {
+			log.Printf("Ignoring crop of %v, must be within 0 to 1: %+v\n", filename, *crop)
+			return img
+		}
+		bounds := img.Bounds()
+		width := float64(bounds.Dx())
+		height := float64(bounds.Dy())
+		keep := image.Rect(
+			bounds.Min.X+int(math.Round(crop.Left*width)),
+			bounds.Min.Y+int(math.Round(crop.Top*height)),
+			bounds.Min.X+int(math.Round(crop.Right*width)),
+			bounds.Min.Y+int(math.Round(crop.Bottom*height)),
+		)
+		if !keep.Empty() {
+			img = imaging.Crop(img, keep)
+		}
+	}
+	return img
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Cropping photos to fill a box of a different shape. Rather than always
+// keeping the middle, as background-size:cover and imaging.Fill do, the
+// part kept is the one with the most detail in it, detail being where the
+// brightness changes most, with a slight preference for the middle, so
+// subjects standing off centre against sky or a plain wall aren't cut off.
+// Any faces found when the photo was indexed are kept in whatever's kept,
+// as far as they'll fit.
+
+// The photo is scaled down to this many pixels on its longer side to look
+// for the detail, which is plenty to find where the subject is
+const saliency_size = 96
+
+func smart_crop(img image.Image, width int, height int, faces []FaceBox) image.Image {
+	// The photo cropped to the shape of width x height and resized to it
+	region := crop_region(img, float64(width)/float64(height), faces)
+	return imaging.Resize(imaging.Crop(img, region), width, height, imaging.Lanczos)
+}
+
+func crop_region(img image.Image, aspect float64, faces []FaceBox) image.Rectangle {
+	// The part of img with the given aspect ratio to keep
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	crop_width := width
+	crop_height := height
+	if float64(width)/float64(height) > aspect {
+		crop_width = int(math.Round(float64(height) * aspect))
+	} else {
+		crop_height = int(math.Round(float64(width) / aspect))
+	}
+	if crop_width < 1 || crop_height < 1 || (crop_width == width && crop_height == height) {
+		return bounds
+	}
+
+	small := imaging.Fit(img, saliency_size, saliency_size, imaging.Box)
+	detail := detail_map(small)
+	scale := float64(small.Bounds().Dx()) / float64(width)
+
+	// Everything the faces take up, in img's own pixels
+	keep := image.Rectangle{}
+	for _, face := range faces {
+		keep = keep.Union(face.rect())
+	}
+
+	if crop_width < width {
+		profile := make([]float64, small.Bounds().Dx())
+		for y, row := range detail {
+			for x := range row {
+				profile[x] += detail[y][x]
+			}
+		}
+		offset := best_window(profile, float64(crop_width)*scale, float64(keep.Min.X)*scale, float64(keep.Max.X)*scale) / scale
+		x := bounds.Min.X + clamp_int(int(math.Round(offset)), 0, width-crop_width)
+		return image.Rect(x, bounds.Min.Y, x+crop_width, bounds.Max.Y)
+	}
+	profile := make([]float64, small.Bounds().Dy())
+	for y, row := range detail {
+		for _, value := range row {
+			profile[y] += value
+		}
+	}
+	offset := best_window(profile, float64(crop_height)*scale, float64(keep.Min.Y)*scale, float64(keep.Max.Y)*scale) / scale
+	y := bounds.Min.Y + clamp_int(int(math.Round(offset)), 0, height-crop_height)
+	return image.Rect(bounds.Min.X, y, bounds.Max.X, y+crop_height)
+}
+
+func detail_map(img *image.NRGBA) [][]float64 {
+	// How much the brightness changes at each pixel, [y][x]
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+	luma := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		luma[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			pixel := img.Pix[y*img.Stride+x*4:]
+			luma[y][x] = 0.299*float64(pixel[0]) + 0.587*float64(pixel[1]) + 0.114*float64(pixel[2])
+		}
+	}
+	detail := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		detail[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			dx := luma[y][min_int(x+1, width-1)] - luma[y][max_int(x-1, 0)]
+			dy := luma[min_int(y+1, height-1)][x] - luma[max_int(y-1, 0)][x]
+			detail[y][x] = math.Sqrt(dx*dx + dy*dy)
+		}
+	}
+	return detail
+}
+
+func best_window(profile []float64, length float64, keep_from float64, keep_to float64) float64 {
+	/*
+		Where a window length long (in profile's units, not necessarily
+		whole) should start along profile to take in the most of it,
+		each position weighted a little towards the middle. If keep_to is
+		after keep_from the window has to take in all of keep_from to
+		keep_to, or be centred on it if it's too long to.
+	*/
+	n := len(profile)
+	window := clamp_int(int(math.Round(length)), 1, n)
+	if window >= n {
+		return 0
+	}
+	earliest, latest := 0, n-window
+	if keep_to > keep_from {
+		if keep_to-keep_from >= length {
+			return (keep_from+keep_to)/2 - length/2
+		}
+		earliest = clamp_int(int(math.Ceil(keep_to-length)), 0, n-window)
+		latest = clamp_int(int(math.Floor(keep_from)), earliest, n-window)
+	}
+	centre := float64(n-1) / 2
+	weighted := make([]float64, n)
+	total := 0.0
+	for i, value := range profile {
+		distance := (float64(i) - centre) / (centre + 1)
+		weighted[i] = value * (1 - 0.3*distance*distance)
+		total += value
+	}
+	if total == 0 {
+		// Nothing to go on, so as near the middle as allowed
+		return math.Max(float64(earliest), math.Min(float64(latest), float64(n)/2-length/2))
+	}
+
+	sum := 0.0
+	for i := earliest; i < earliest+window; i++ {
+		sum += weighted[i]
+	}
+	best := earliest
+	best_sum := sum
+	for start := earliest + 1; start <= latest; start++ {
+		sum += weighted[start+window-1] - weighted[start-1]
+		if sum > best_sum {
+			best = start
+			best_sum = sum
+		}
+	}
+	// Fine tune from the window's whole-pixel start to the actual length
+	return float64(best) + (float64(window)-length)/2
+}
+
+func max_int(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func clamp_int(value int, low int, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
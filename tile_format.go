@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// How photoHandler encodes a tile. Photos are served as jpeg, with the
+// quality dropping as tiles get smaller since the artefacts can't be
+// seen at that size anyway, except lossless originals (screenshots,
+// scans, diagrams) which are served as png so they stay crisp. Either
+// can be overridden with ?format= and ?quality=, and whatever the
+// browser's Accept header rules out is avoided.
+
+type TileFormat struct {
+	Name    string // "jpeg" or "png"
+	Quality int    // jpeg only, 1-100
+}
+
+var tile_content_types = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// Originals in these formats are served as png by default
+var lossless_extensions = map[string]bool{
+	".png":  true,
+	".gif":  true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+// When the Accept header rules out everything we can serve
+var not_acceptable = errors.New("can only serve image/jpeg or image/png")
+
+func default_tile_quality(width int) int {
+	switch {
+	case width <= 300:
+		return 70
+	case width <= 1000:
+		return 80
+	default:
+		return 90
+	}
+}
+
+func default_tile_format(filename string, width int) TileFormat {
+	// What a tile width pixels wide is sent as when either format will do
+	if lossless_extensions[strings.ToLower(filepath.Ext(filename))] {
+		return TileFormat{Name: "png"}
+	}
+	return TileFormat{Name: "jpeg", Quality: default_tile_quality(width)}
+}
+
+func choose_tile_format(request *http.Request, filename string, width int) (TileFormat, error) {
+	accept := request.Header.Get("Accept")
+
+	name := request.URL.Query().Get("format")
+	switch name {
+	case "jpg":
+		name = "jpeg"
+	case "jpeg", "png":
+	case "":
+		// Nothing asked for, so it's up to us and the Accept header
+		name = default_tile_format(filename, width).Name
+		if !accepts(accept, tile_content_types[name]) {
+			name = map[string]string{"jpeg": "png", "png": "jpeg"}[name]
+		}
+	default:
+		return TileFormat{}, fmt.Errorf("format must be jpeg or png")
+	}
+	if !accepts(accept, tile_content_types[name]) {
+		return TileFormat{}, not_acceptable
+	}
+
+	format := TileFormat{Name: name}
+	if name == "jpeg" {
+		quality, err := optional_int_parameter(request, "quality", default_tile_quality(width), 1, 100)
+		if err != nil {
+			return TileFormat{}, err
+		}
+		format.Quality = quality
+	}
+	return format, nil
+}
+
+func accepts(accept string, content_type string) bool {
+	/*
+		Whether an Accept header allows content_type, an empty header
+		allowing anything. The most specific matching entry decides, and
+		quality values are only looked at to see if it's ruled out with
+		q=0, not to rank the choices
+	*/
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	major := strings.SplitN(content_type, "/", 2)[0]
+	for _, wanted := range []string{content_type, major + "/*", "*/*"} {
+		for _, entry := range strings.Split(accept, ",") {
+			parts := strings.Split(entry, ";")
+			if strings.TrimSpace(parts[0]) != wanted {
+				continue
+			}
+			for _, parameter := range parts[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+				if q, err := strconv.ParseFloat(value, 64); key == "q" && err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (format TileFormat) content_type() string {
+	return tile_content_types[format.Name]
+}
+
+func (format TileFormat) encode(img image.Image) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	var err error
+	if format.Name == "png" {
+		err = png.Encode(buffer, img)
+	} else {
+		err = jpeg.Encode(buffer, img, &jpeg.Options{Quality: format.Quality})
+	}
+	return buffer.Bytes(), err
+}
+
+func (format TileFormat) String() string {
+	if format.Name == "png" {
+		return "png"
+	}
+	return fmt.Sprintf("jpeg-%d", format.Quality)
+}
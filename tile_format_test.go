@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		accept       string
+		content_type string
+		want         bool
+	}{
+		{"", "image/jpeg", true},
+		{"   ", "image/png", true},
+		{"image/jpeg", "image/jpeg", true},
+		{"image/avif,image/webp,image/png,*/*;q=0.8", "image/png", true},
+		{"image/png", "image/jpeg", false},
+		{"image/*", "image/jpeg", true},
+		{"*/*", "image/png", true},
+		{"text/html", "image/jpeg", false},
+		{" image/png ; q=0.5 ", "image/png", true},
+
+		// Ruled out with q=0, however it's written
+		{"image/jpeg;q=0", "image/jpeg", false},
+		{"image/jpeg; q=0.0", "image/jpeg", false},
+		{"image/png;q=0.000", "image/png", false},
+		{"image/png;q=0.001", "image/png", true},
+
+		// The most specific entry decides
+		{"image/jpeg;q=0, image/*", "image/jpeg", false},
+		{"image/jpeg;q=0, image/*", "image/png", true},
+		{"image/*;q=0, image/png", "image/png", true},
+		{"image/*;q=0, */*", "image/jpeg", false},
+		{"*/*;q=0, image/*", "image/png", true},
+		{"*/*;q=0", "image/jpeg", false},
+
+		// Broken parameters are ignored rather than ruling anything out
+		{"image/jpeg;q=", "image/jpeg", true},
+		{"image/png;q=abc", "image/png", true},
+		{"image/jpeg;level", "image/jpeg", true},
+		{",,", "image/jpeg", false},
+	}
+	for _, test := range tests {
+		if got := accepts(test.accept, test.content_type); got != test.want {
+			t.Errorf("accepts(%q, %q) = %v, want %v", test.accept, test.content_type, got, test.want)
+		}
+	}
+}
+
+func TestChooseTileFormat(t *testing.T) {
+	jpeg := func(quality int) TileFormat { return TileFormat{Name: "jpeg", Quality: quality} }
+	png := TileFormat{Name: "png"}
+	tests := []struct {
+		name     string
+		query    string
+		accept   string
+		filename string
+		width    int
+		want     TileFormat
+		wantErr  bool
+	}{
+		{"jpeg original", "", "", "2019/Skye/IMG_0042.jpg", 800, jpeg(80), false},
+		{"png original", "", "", "scan.png", 800, png, false},
+		{"gif original", "", "", "anim.GIF", 800, png, false},
+		{"bmp original", "", "", "old.bmp", 800, png, false},
+		{"tif original", "", "", "film.tif", 800, png, false},
+
+		{"jpeg ruled out", "", "image/png", "IMG_0042.jpg", 800, png, false},
+		{"png ruled out", "", "image/*, image/png;q=0", "scan.png", 800, jpeg(80), false},
+		{"both ruled out", "", "image/webp", "IMG_0042.jpg", 800, TileFormat{}, true},
+		{"both ruled out, png original", "", "text/html", "scan.png", 800, TileFormat{}, true},
+		{"asked for a format ruled out", "format=png", "image/jpeg", "scan.png", 800, TileFormat{}, true},
+
+		{"format=jpg", "format=jpg", "", "scan.png", 800, jpeg(80), false},
+		{"format=jpeg", "format=jpeg", "", "scan.png", 800, jpeg(80), false},
+		{"format=png", "format=png", "", "IMG_0042.jpg", 800, png, false},
+		{"format=webp", "format=webp", "", "IMG_0042.jpg", 800, TileFormat{}, true},
+
+		{"small tile", "", "", "IMG_0042.jpg", 300, jpeg(70), false},
+		{"medium tile", "", "", "IMG_0042.jpg", 1000, jpeg(80), false},
+		{"large tile", "", "", "IMG_0042.jpg", 1001, jpeg(90), false},
+		{"quality", "quality=55", "", "IMG_0042.jpg", 300, jpeg(55), false},
+		{"lowest quality", "quality=1", "", "IMG_0042.jpg", 300, jpeg(1), false},
+		{"highest quality", "quality=100", "", "IMG_0042.jpg", 300, jpeg(100), false},
+		{"quality too low", "quality=0", "", "IMG_0042.jpg", 300, TileFormat{}, true},
+		{"quality too high", "quality=101", "", "IMG_0042.jpg", 300, TileFormat{}, true},
+		{"quality not a number", "quality=best", "", "IMG_0042.jpg", 300, TileFormat{}, true},
+		{"quality ignored for png", "quality=101", "", "scan.png", 300, png, false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/photograph/"+test.filename+"?"+test.query, nil)
+		if test.accept != "" {
+			request.Header.Set("Accept", test.accept)
+		}
+		got, err := choose_tile_format(request, test.filename, test.width)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: error %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%v: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/photograph/IMG_0042.jpg", nil)
+	request.Header.Set("Accept", "text/html")
+	if _, err := choose_tile_format(request, "IMG_0042.jpg", 800); err != not_acceptable {
+		t.Errorf("both ruled out: error %v, want not_acceptable", err)
+	}
+}
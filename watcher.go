@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Keeps the photo index in step with the photos directory while the
+// server runs. Changes are noticed through inotify where possible, with
+// a periodic rescan as well in case any are missed (or as the only
+// means, where the directory can't be watched e.g. some network shares)
+// Everything that changes in the index is published as a PhotoEvent to
+// whoever has subscribed.
+
+type PhotoEventKind int
+
+const (
+	PhotoAdded PhotoEventKind = iota
+	PhotoChanged
+	PhotoRemoved
+)
+
+func (kind PhotoEventKind) String() string {
+	return [...]string{"added", "changed", "removed"}[kind]
+}
+
+type PhotoEvent struct {
+	Kind     PhotoEventKind
+	Filename string
+}
+
+// How long the directory has to be quiet before rescanning, so copying
+// in a whole folder of photos results in one rescan rather than hundreds
+const settle_time = 2 * time.Second
+
+func (index *PhotoIndex) subscribe() <-chan PhotoEvent {
+	events := make(chan PhotoEvent, 100)
+	index.mutex.Lock()
+	index.subscribers = append(index.subscribers, events)
+	index.mutex.Unlock()
+	return events
+}
+
+func (index *PhotoIndex) publish(event PhotoEvent) {
+	log.Printf("Photo %v: %v\n", event.Kind, event.Filename)
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	for _, events := range index.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("Subscriber too slow, dropped event for %v\n", event.Filename)
+		}
+	}
+}
+
+func (index *PhotoIndex) watch(scan_interval time.Duration) {
+	// Starts watching in the background, returning straight away
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watch_tree(watcher, index.image_path)
+	}
+	if err != nil {
+		log.Printf("Can't watch %v, rescanning every %v instead: %v\n", index.image_path, scan_interval, err)
+		if watcher != nil {
+			watcher.Close()
+		}
+		go index.follow(nil, scan_interval)
+		return
+	}
+	go index.follow(watcher, scan_interval)
+}
+
+func (index *PhotoIndex) follow(watcher *fsnotify.Watcher, scan_interval time.Duration) {
+	// A nil watcher just rescans every scan_interval
+	var events chan fsnotify.Event
+	var errors chan error
+	if watcher != nil {
+		defer watcher.Close()
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+
+	rescan := time.NewTicker(scan_interval)
+	defer rescan.Stop()
+	settle := time.NewTimer(settle_time)
+	settle.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				// A new album needs watching too
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watch_tree(watcher, event.Name); err != nil {
+						log.Printf("Can't watch new folder %v: %v\n", event.Name, err)
+					}
+				}
+			}
+			settle.Reset(settle_time)
+		case err, ok := <-errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching the photos: %v\n", err)
+		case <-settle.C:
+			index.refresh_logged()
+		case <-rescan.C:
+			index.refresh_logged()
+		}
+	}
+}
+
+func watch_tree(watcher *fsnotify.Watcher, root string) error {
+	// inotify doesn't recurse, so every folder under root is watched
+	// separately, skipping hidden ones just as find_photos does
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return err
+		}
+		if path != filepath.Clean(root) && strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+func (index *PhotoIndex) refresh_logged() {
+	if err := index.refresh(); err != nil {
+		log.Printf("Couldn't refresh the photo index: %v\n", err)
+	}
+}